@@ -1,14 +1,17 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/base64"
+	"encoding/csv"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
@@ -17,9 +20,38 @@ import (
 type attachmentInfo struct {
 	filename string
 	section  string
+	// Content-Transfer-Encoding and MIME type of the part, lower case
+	encoding string
+	mimeType string
+	// Encoded size in bytes as the server reports it
+	size uint32
 }
 
-var downloadedHashes = make(map[string]string)
+// Name of the per-run manifest in the output directory
+const manifestFile = "manifest.csv"
+
+// messageInfo describes the message an attachment belongs to
+type messageInfo struct {
+	uid       uint32
+	messageID string
+	subject   string
+	from      string
+	account   string
+	folder    string
+}
+
+// newMessageInfo describes a fetched message of a folder
+func newMessageInfo(msg *imap.Message, account *Account, folder string) messageInfo {
+	info := messageInfo{uid: msg.Uid, account: account.label(), folder: folder}
+	if msg.Envelope != nil {
+		info.subject = msg.Envelope.Subject
+		info.messageID = msg.Envelope.MessageId
+		if len(msg.Envelope.From) > 0 && msg.Envelope.From[0] != nil {
+			info.from = msg.Envelope.From[0].Address()
+		}
+	}
+	return info
+}
 
 var attachmentRegex = regexp.MustCompile(`(?i)` +
 	`(inv(oice)?s?|bill(s|ing)?|receipt|rec|rct|cheque|check|` +
@@ -43,42 +75,47 @@ func findAttachments(bodyStructure *imap.BodyStructure, path []string) []attachm
 	// Check if this is an attachment
 	if bodyStructure.Disposition == "attachment" || 
 	   bodyStructure.Disposition == "inline" ||
-	   (bodyStructure.DispositionParams != nil && bodyStructure.DispositionParams["filename"] != "") ||
-	   (bodyStructure.Params != nil && bodyStructure.Params["name"] != "") ||
+	   paramValue(bodyStructure.DispositionParams, "filename") != "" ||
+	   paramValue(bodyStructure.Params, "name") != "" ||
 	   (bodyStructure.MIMEType == "application" && (bodyStructure.MIMESubType == "pdf" || bodyStructure.MIMESubType == "octet-stream")) ||
 	   (bodyStructure.MIMEType == "application" && (bodyStructure.MIMESubType == "vnd.ms-excel" || bodyStructure.MIMESubType == "vnd.openxmlformats-officedocument.spreadsheetml.sheet")) ||
 	   (bodyStructure.MIMEType == "application" && bodyStructure.MIMESubType == "zip") ||
 	   (bodyStructure.MIMEType == "image" && (bodyStructure.MIMESubType == "png" || bodyStructure.MIMESubType == "jpeg" || bodyStructure.MIMESubType == "jpg" || bodyStructure.MIMESubType == "gif" || bodyStructure.MIMESubType == "bmp" || bodyStructure.MIMESubType == "tiff")) {
 		
-		filename := ""
-		if bodyStructure.DispositionParams != nil && bodyStructure.DispositionParams["filename"] != "" {
-			filename = bodyStructure.DispositionParams["filename"]
-		} else if bodyStructure.Params != nil && bodyStructure.Params["name"] != "" {
-			filename = bodyStructure.Params["name"]
-		} else if bodyStructure.MIMEType == "application" && bodyStructure.MIMESubType == "pdf" {
-			filename = "attachment.pdf"
-		} else if bodyStructure.MIMEType == "application" && bodyStructure.MIMESubType == "octet-stream" {
-			filename = "attachment.bin"
-		} else if bodyStructure.MIMEType == "application" && bodyStructure.MIMESubType == "vnd.ms-excel" {
-			filename = "attachment.xls"
-		} else if bodyStructure.MIMEType == "application" && bodyStructure.MIMESubType == "vnd.openxmlformats-officedocument.spreadsheetml.sheet" {
-			filename = "attachment.xlsx"
-		} else if bodyStructure.MIMEType == "image" && bodyStructure.MIMESubType == "png" {
-			filename = "attachment.png"
-		} else if bodyStructure.MIMEType == "image" && (bodyStructure.MIMESubType == "jpeg" || bodyStructure.MIMESubType == "jpg") {
-			filename = "attachment.jpg"
-		} else if bodyStructure.MIMEType == "image" && bodyStructure.MIMESubType == "gif" {
-			filename = "attachment.gif"
-		} else if bodyStructure.MIMEType == "image" && bodyStructure.MIMESubType == "bmp" {
-			filename = "attachment.bmp"
-		} else if bodyStructure.MIMEType == "image" && bodyStructure.MIMESubType == "tiff" {
-			filename = "attachment.tiff"
+		// Names may be RFC 2047 encoded-words or RFC 2231 extended values
+		filename := paramValue(bodyStructure.DispositionParams, "filename")
+		if filename == "" {
+			filename = paramValue(bodyStructure.Params, "name")
+		}
+		if filename == "" {
+			if bodyStructure.MIMEType == "application" && bodyStructure.MIMESubType == "pdf" {
+				filename = "attachment.pdf"
+			} else if bodyStructure.MIMEType == "application" && bodyStructure.MIMESubType == "octet-stream" {
+				filename = "attachment.bin"
+			} else if bodyStructure.MIMEType == "application" && bodyStructure.MIMESubType == "vnd.ms-excel" {
+				filename = "attachment.xls"
+			} else if bodyStructure.MIMEType == "application" && bodyStructure.MIMESubType == "vnd.openxmlformats-officedocument.spreadsheetml.sheet" {
+				filename = "attachment.xlsx"
+			} else if bodyStructure.MIMEType == "image" && bodyStructure.MIMESubType == "png" {
+				filename = "attachment.png"
+			} else if bodyStructure.MIMEType == "image" && (bodyStructure.MIMESubType == "jpeg" || bodyStructure.MIMESubType == "jpg") {
+				filename = "attachment.jpg"
+			} else if bodyStructure.MIMEType == "image" && bodyStructure.MIMESubType == "gif" {
+				filename = "attachment.gif"
+			} else if bodyStructure.MIMEType == "image" && bodyStructure.MIMESubType == "bmp" {
+				filename = "attachment.bmp"
+			} else if bodyStructure.MIMEType == "image" && bodyStructure.MIMESubType == "tiff" {
+				filename = "attachment.tiff"
+			}
 		}
 		
 		if filename != "" {
 			attachments = append(attachments, attachmentInfo{
 				filename: filename,
 				section:  currentPath,
+				encoding: strings.ToLower(bodyStructure.Encoding),
+				mimeType: strings.ToLower(bodyStructure.MIMEType + "/" + bodyStructure.MIMESubType),
+				size:     bodyStructure.Size,
 			})
 		}
 	}
@@ -97,18 +134,46 @@ func findAttachments(bodyStructure *imap.BodyStructure, path []string) []attachm
 	return attachments
 }
 
-func isInvoiceFile(filename string, keywords []string) bool {
-	if filename == "" {
-		return false
+// findTextParts returns the text/plain and text/html bodies of a message
+func findTextParts(bodyStructure *imap.BodyStructure, path []string) []attachmentInfo {
+	var parts []attachmentInfo
+	
+	if bodyStructure == nil {
+		return parts
 	}
 	
-	lower := strings.ToLower(filename)
+	if bodyStructure.MIMEType == "multipart" || len(bodyStructure.Parts) > 0 {
+		for i, part := range bodyStructure.Parts {
+			partPath := append(append([]string{}, path...), fmt.Sprintf("%d", i+1))
+			parts = append(parts, findTextParts(part, partPath)...)
+		}
+		return parts
+	}
 	
-	// Exclude calendar files and invitations
-	if strings.Contains(lower, "invite.ics") || strings.Contains(lower, "invite") {
-		return false
+	currentPath := strings.Join(path, ".")
+	if currentPath == "" {
+		currentPath = "1"
+	}
+	
+	mimeType := strings.ToLower(bodyStructure.MIMEType + "/" + bodyStructure.MIMESubType)
+	if (mimeType == "text/plain" || mimeType == "text/html") && !strings.EqualFold(bodyStructure.Disposition, "attachment") {
+		parts = append(parts, attachmentInfo{
+			section:  currentPath,
+			encoding: strings.ToLower(bodyStructure.Encoding),
+			mimeType: mimeType,
+		})
+	}
+	return parts
+}
+
+// invoiceFileMatch describes why an attachment name looks like an invoice, or returns ""
+func invoiceFileMatch(filename string, keywords []string) string {
+	if filename == "" {
+		return ""
 	}
 	
+	lower := strings.ToLower(filename)
+	
 	// Exclude typical interface images (logos, icons, avatars)
 	excludeImages := []string{
 		"logo", "icon", "avatar", "footer", "header", "banner", 
@@ -119,7 +184,7 @@ func isInvoiceFile(filename string, keywords []string) bool {
 	
 	for _, exclude := range excludeImages {
 		if strings.Contains(lower, exclude) {
-			return false
+			return ""
 		}
 	}
 	
@@ -133,81 +198,63 @@ func isInvoiceFile(filename string, keywords []string) bool {
 		// Images must contain explicit invoice or receipt indicators from keywords
 		for _, keyword := range keywords {
 			if strings.Contains(lower, strings.ToLower(keyword)) {
-				return true
+				return fmt.Sprintf("keyword %q", keyword)
 			}
 		}
 		
 		// Or match regex patterns
-		if attachmentRegex.MatchString(filename) {
-			return true
+		if match := attachmentRegex.FindString(filename); match != "" {
+			return fmt.Sprintf("invoice name pattern %q", match)
 		}
 		
-		return false
+		return ""
 	}
 	
 	// For non-images, use regular logic
-	if attachmentRegex.MatchString(filename) {
-		return true
+	if match := attachmentRegex.FindString(filename); match != "" {
+		return fmt.Sprintf("invoice name pattern %q", match)
 	}
 	
 	// Special case: if generic attachment name and not image, consider potential invoice
 	if !isImage && (filename == "attachment.pdf" || filename == "attachment.xlsx" || filename == "attachment.xls") {
-		return true
+		return "generic document name"
 	}
 	
 	// Use configured keywords for detection
 	for _, keyword := range keywords {
 		if strings.Contains(lower, strings.ToLower(keyword)) {
-			return true
+			return fmt.Sprintf("keyword %q", keyword)
 		}
 	}
 	
-	return false
+	// Vendor file name patterns of the registry
+	if vendor, pattern := vendorPattern(lower, func(v *Vendor) []string { return v.FilenamePatterns }); vendor != nil {
+		return fmt.Sprintf("%s file name pattern %q", vendor.ID, pattern)
+	}
+	
+	return ""
 }
 
+// detectServiceFromSubject returns the naming prefix of the first vendor of
+// the registry named in the subject, or ""
 func detectServiceFromSubject(subject string) string {
 	lower := strings.ToLower(subject)
 	
-	// Check more specific patterns first, then general ones
-	servicePatterns := []struct {
-		patterns []string
-		prefix   string
-	}{
-		{[]string{"google workspace"}, "gworkspace"},
-		{[]string{"google cloud platform", "google cloud"}, "gcloud"},
-		{[]string{"digital realty"}, "digitalrealty"},
-		{[]string{"trafficcake"}, "trafficcake"},
-		{[]string{"statuscake"}, "statuscake"},
-		{[]string{"mailgun technologies", "mailgun"}, "mailgun"},
-		{[]string{"pagerduty"}, "pagerduty"},
-		{[]string{"github"}, "github"},
-		{[]string{"anthropic"}, "anthropic"},
-		{[]string{"fastly"}, "fastly"},
-		{[]string{"amazon web services", "aws"}, "aws"},
-		{[]string{"stripe"}, "stripe"},
-		{[]string{"firebase"}, "firebase"},
-		{[]string{"twilio"}, "twilio"},
-		{[]string{"slack"}, "slack"},
-		{[]string{"linear orbit", "linear"}, "linear"},
-		{[]string{"zoom"}, "zoom"},
-		{[]string{"hetzner"}, "hetzner"},
-		{[]string{"cogent communications"}, "cogent"},
-		{[]string{"zayo network"}, "zayo"},
-		{[]string{"lottielab"}, "lottielab"},
-		{[]string{"zoominfo"}, "zoominfo"},
-	}
-	
-	for _, service := range servicePatterns {
-		for _, pattern := range service.patterns {
-			if strings.Contains(lower, pattern) {
-				return service.prefix
-			}
+	// Registry order: more specific patterns first, then general ones
+	vendor, _ := vendorPattern(lower, func(v *Vendor) []string {
+		if v.Prefix == "" {
+			return nil
 		}
+		return v.SubjectPatterns
+	})
+	if vendor == nil {
+		return ""
 	}
-	
-	return ""
+	return vendor.Prefix
 }
 
+// detectServiceFromEmail returns the naming prefix of the vendor of the
+// sender's domain or its closest parent domain, or ""
 func detectServiceFromEmail(email string) string {
 	if email == "" {
 		return ""
@@ -222,132 +269,110 @@ func detectServiceFromEmail(email string) string {
 	}
 	domain := lower[atIndex+1:]
 	
-	// Map domains to service prefixes
-	domainMap := map[string]string{
-		"mailgun.com": "mailgun",
-		"mg.mailgun.com": "mailgun",
-		"pagerduty.com": "pagerduty",
-		"statuspage.pagerduty.com": "pagerduty",
-		"statuscake.com": "statuscake",
-		"trafficcake.com": "trafficcake",
-		"github.com": "github",
-		"noreply.github.com": "github",
-		"anthropic.com": "anthropic",
-		"workspace-noreply.google.com": "gworkspace",
-		"googlecloud.com": "gcloud",
-		"cloud-noreply.google.com": "gcloud",
-		"google.com": "google",
-		"digitalrealty.com": "digitalrealty",
-		"fastly.com": "fastly",
-		"amazon.com": "aws",
-		"amazonaws.com": "aws",
-		"awscloud.com": "aws",
-		"stripe.com": "stripe",
-		"firebase.google.com": "firebase",
-		"twilio.com": "twilio",
-		"slack.com": "slack",
-		"linear.app": "linear",
-		"zoom.us": "zoom",
-		"hetzner.com": "hetzner",
-		"cogentco.com": "cogent",
-		"zayo.com": "zayo",
-		"lottielab.com": "lottielab",
-		"zoominfo.com": "zoominfo",
-	}
-	
-	// Exact domain match
-	if prefix, exists := domainMap[domain]; exists {
-		return prefix
-	}
-	
-	// Check subdomains (e.g. billing.stripe.com -> stripe)
-	for domainKey, prefix := range domainMap {
-		if strings.HasSuffix(domain, "."+domainKey) {
-			return prefix
+	// Exact domain match wins, then the longest parent domain
+	// (e.g. billing.stripe.com -> stripe)
+	prefix, matched := "", ""
+	for _, v := range vendors {
+		if v.Prefix == "" {
+			continue
+		}
+		for _, vendorDomain := range v.Domains {
+			if domain == vendorDomain {
+				return v.Prefix
+			}
+			if strings.HasSuffix(domain, "."+vendorDomain) && len(vendorDomain) > len(matched) {
+				prefix, matched = v.Prefix, vendorDomain
+			}
 		}
 	}
 	
-	return ""
+	return prefix
 }
 
-func downloadAttachment(c *client.Client, uid uint32, attachment attachmentInfo, outputDir string, subject string, fromEmail string) error {
-	// Check if directory exists
-	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
-		err = os.MkdirAll(outputDir, 0755)
-		if err != nil {
-			return fmt.Errorf("error creating directory %s: %v", outputDir, err)
-		}
+// downloadAttachments fetches the wanted attachments of a batch of messages
+// and saves them, returning the number of saved files. The error joins the
+// fetch failures only: parts the server did not return or broke off can be
+// retried, attachments with bad content are just reported as failed.
+func downloadAttachments(c *client.Client, requests []sectionRequest, outputDir string) (int, error) {
+	if len(requests) == 0 {
+		return 0, nil
 	}
 	
-	
-	// Create seqset for this specific email
-	seqset := new(imap.SeqSet)
-	seqset.AddNum(uid)
-	
-	// Request specific section
-	section := &imap.BodySectionName{}
-	if attachment.section != "" {
-		pathStrings := strings.Split(attachment.section, ".")
-		section.Path = make([]int, len(pathStrings))
-		for i, p := range pathStrings {
-			if p == "" {
-				section.Path[i] = 1
-			} else {
-				var num int
-				fmt.Sscanf(p, "%d", &num)
-				section.Path[i] = num
-			}
+	// Each batch is saved before the next one is fetched, so at most
+	// maxFetchBytes of attachments are held in memory
+	count := 0
+	var fetchErrs error
+	for _, batch := range splitFetchBatches(requests) {
+		parts, fetchErr := fetchSections(c, batch, 0)
+		if fetchErr != nil {
+			fmt.Printf("Download error: %v\n", fetchErr)
+			fetchErrs = errors.Join(fetchErrs, fetchErr)
 		}
-	}
-	
-	messages := make(chan *imap.Message, 1)
-	done := make(chan error, 1)
-	go func() {
-		done <- c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages)
-	}()
-	
-	var attachmentData []byte
-	for msg := range messages {
-		if msg.Body != nil {
-			for sectionName, reader := range msg.Body {
-				if sectionName.Path != nil && len(sectionName.Path) > 0 {
-					data, err := io.ReadAll(reader)
-					if err != nil {
-						return fmt.Errorf("data read error: %v", err)
-					}
-					attachmentData = data
-					break
+		
+		for _, req := range batch {
+			part, ok := parts[req.info.uid][req.attachment.section]
+			if !ok {
+				err := fetchErr
+				if err == nil {
+					err = fmt.Errorf("%w: %s was not returned by the server", errFetch, req.attachment.filename)
+					fmt.Printf("Download error: %v\n", err)
+					fetchErrs = errors.Join(fetchErrs, err)
 				}
+				report.record(req.info, req.attachment, outcomeFailed, "", err, req.reasons)
+				continue
+			}
+			
+			rec, err := saveAttachment(req.info, req.attachment, part, outputDir, req.reasons)
+			if errors.Is(err, errAlreadyArchived) {
+				fmt.Printf("Skipped %s, %v\n", req.attachment.filename, err)
+				report.record(req.info, req.attachment, outcomeAlreadyHave, rec.Path, nil, req.reasons)
+			} else if err != nil {
+				fmt.Printf("Download error: %v\n", err)
+				report.record(req.info, req.attachment, outcomeFailed, "", err, req.reasons)
+				if errors.Is(err, errFetch) {
+					fetchErrs = errors.Join(fetchErrs, err)
+				}
+			} else {
+				report.record(req.info, req.attachment, outcomeDownloaded, rec.Path, nil, req.reasons)
+				count++
 			}
 		}
 	}
+	return count, fetchErrs
+}
+
+// saveAttachment writes a fetched part to the output directory and records it
+// in the index; for content archived earlier it returns the existing record
+func saveAttachment(info messageInfo, attachment attachmentInfo, part fetchedPart, outputDir string, reasons []reason) (*indexRecord, error) {
+	uid, subject, fromEmail := info.uid, info.subject, info.from
 	
-	if err := <-done; err != nil {
-		return fmt.Errorf("attachment fetch error: %v", err)
-	}
-	
-	if len(attachmentData) == 0 {
-		return fmt.Errorf("attachment is empty")
+	// Check if directory exists
+	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
+		err = os.MkdirAll(outputDir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("error creating directory %s: %v", outputDir, err)
+		}
 	}
 	
-	// Decode Base64 if necessary
-	decodedData, err := base64.StdEncoding.DecodeString(string(attachmentData))
+	// Decode, hash and write in one pass; the temp file is gone once committed
+	file, err := streamToTempFile(part.body, part.encoding, attachment, outputDir)
 	if err != nil {
-		// If decoding failed, use original data
-		decodedData = attachmentData
+		return nil, err
 	}
+	defer os.Remove(file.path)
 	
-	// Check for duplicates by MD5 BEFORE adding numbers to filename
-	hasher := md5.New()
-	hasher.Write(decodedData)
-	fileHash := fmt.Sprintf("%x", hasher.Sum(nil))
-	
-	if _, exists := downloadedHashes[fileHash]; exists {
-		return nil
+	// Check for duplicates in the index BEFORE adding numbers to filename
+	if rec := archive.lookup(file.hash); rec != nil {
+		// Duplicates within this run are not "from earlier runs"
+		if archive.fromEarlierRun(rec) {
+			archive.alreadyHave++
+		}
+		return rec, fmt.Errorf("%w: %s", errAlreadyArchived, rec.Path)
 	}
 	
-	// NOW determine service and create final filename
-	filename := attachment.filename
+	// NOW determine service and create final filename; the sender's name
+	// must not pick the directory
+	filename := sanitizeFilename(attachment.filename)
 	servicePrefix := detectServiceFromEmail(fromEmail)
 	if servicePrefix == "" {
 		servicePrefix = detectServiceFromSubject(subject)
@@ -369,39 +394,86 @@ func downloadAttachment(c *client.Client, uid uint32, attachment attachmentInfo,
 	
 	// Full file path with existence check
 	filePath := filepath.Join(outputDir, filename)
+	if filepath.Dir(filePath) != filepath.Clean(outputDir) {
+		return nil, fmt.Errorf("unsafe attachment name %q", attachment.filename)
+	}
 	
-	// If file already exists, add number
+	// If the name is taken, add a number; the commit never overwrites, so a
+	// file another run saves in the meantime just moves us to the next name
 	originalFilename := filename
-	counter := 1
-	for {
-		if _, err := os.Stat(filePath); err != nil {
-			// File doesn't exist, can use this name
+	for counter := 1; ; counter++ {
+		err := commitTempFile(file.path, filePath)
+		if err == nil {
 			break
 		}
-		
-		// File exists, create new name with number based on original name
-		ext := filepath.Ext(originalFilename)
-		baseName := strings.TrimSuffix(originalFilename, ext)
-		numberedFilename := fmt.Sprintf("%s_%d%s", baseName, counter, ext)
-		filePath = filepath.Join(outputDir, numberedFilename)
-		filename = numberedFilename // Update filename for output
-		counter++
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("file save error: %v", err)
+		}
 		
 		// Protection from infinite loop
 		if counter > 100 {
-			return nil
+			return nil, fmt.Errorf("no free name for %s", originalFilename)
 		}
+		
+		// File exists, create new name with number based on original name
+		ext := filepath.Ext(originalFilename)
+		baseName := strings.TrimSuffix(originalFilename, ext)
+		filename = fmt.Sprintf("%s_%d%s", baseName, counter, ext)
+		filePath = filepath.Join(outputDir, filename)
 	}
 	
-	// Save file
-	err = os.WriteFile(filePath, decodedData, 0644)
-	if err != nil {
-		return fmt.Errorf("file save error: %v", err)
+	// Record in the index
+	rec := &indexRecord{
+		Hash:      file.hash,
+		Size:      file.size,
+		Account:   info.account,
+		Folder:    info.folder,
+		Uid:       uid,
+		MessageID: info.messageID,
+		Filename:  attachment.filename,
+		Path:      archive.relPath(filePath),
+		From:      fromEmail,
+		Subject:   subject,
+		Time:      time.Now(),
+		Reasons:   reasons,
+	}
+	if err := archive.add(rec); err != nil {
+		fmt.Printf("Index save error: %v\n", err)
 	}
 	
-	// Record hash
-	downloadedHashes[fileHash] = filename
+	fmt.Printf("Downloaded: %s (%d bytes)\n", filename, file.size)
+	return rec, nil
+}
+
+// writeManifest appends to a CSV listing which account and folder each downloaded file came from
+func writeManifest(outputDir string) error {
+	if len(archive.added) == 0 {
+		return nil
+	}
 	
-	fmt.Printf("Downloaded: %s (%d bytes)\n", filename, len(decodedData))
-	return nil
-}
\ No newline at end of file
+	files := make([]*indexRecord, len(archive.added))
+	copy(files, archive.added)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	
+	// Incremental runs add to the manifest of earlier runs
+	manifestPath := filepath.Join(outputDir, manifestFile)
+	_, statErr := os.Stat(manifestPath)
+	
+	f, err := os.OpenFile(manifestPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	
+	w := csv.NewWriter(f)
+	if os.IsNotExist(statErr) {
+		w.Write([]string{"file", "account", "folder", "from", "subject"})
+	}
+	for _, file := range files {
+		w.Write([]string{path.Base(file.Path), file.Account, file.Folder, file.From, file.Subject})
+	}
+	w.Flush()
+	return w.Error()
+}
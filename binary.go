@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// supportsBinary reports whether the server decodes parts itself (RFC 3516)
+func supportsBinary(c *client.Client) bool {
+	ok, err := c.Support("BINARY")
+	return err == nil && ok
+}
+
+// literal8Conn rewrites the literal8 syntax of BINARY responses (~{N}) into
+// plain literals ({N}), which go-imap can parse. The stream is read line by
+// line and literal contents are passed through untouched.
+type literal8Conn struct {
+	net.Conn
+	r *bufio.Reader
+	// Rewritten line not yet returned to the reader
+	pending []byte
+	// Literal bytes still to pass through
+	literal int
+}
+
+func newLiteral8Conn(conn net.Conn) *literal8Conn {
+	return &literal8Conn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *literal8Conn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.literal > 0 {
+			n, err := c.r.Read(p[:min(len(p), c.literal)])
+			c.literal -= n
+			return n, err
+		}
+		
+		line, err := c.r.ReadBytes('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		c.pending = c.rewriteLine(line)
+	}
+	
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// rewriteLine notes a literal announced at the end of the line and drops
+// the literal8 marker
+func (c *literal8Conn) rewriteLine(line []byte) []byte {
+	if !bytes.HasSuffix(line, []byte("}\r\n")) {
+		return line
+	}
+	start := bytes.LastIndexByte(line, '{')
+	if start == -1 {
+		return line
+	}
+	
+	size, err := strconv.Atoi(string(line[start+1 : len(line)-3]))
+	if err != nil || size < 0 {
+		return line
+	}
+	c.literal = size
+	
+	if start > 0 && line[start-1] == '~' {
+		line = append(line[:start-1], line[start:]...)
+	}
+	return line
+}
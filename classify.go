@@ -0,0 +1,466 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// Rules that can qualify an attachment for download, enabled per folder
+const (
+	ruleFilename     = "filename"
+	ruleSubject      = "subject"
+	ruleGroup        = "group_address"
+	ruleBody         = "body"
+	ruleSenderDomain = "sender_domain"
+)
+
+var knownRules = []string{ruleFilename, ruleSubject, ruleGroup, ruleBody, ruleSenderDomain}
+
+// Rules that weigh the attachment itself, checked in every folder
+const (
+	ruleDocumentType    = "document_type"
+	ruleImageType       = "image_type"
+	ruleSmallFile       = "small_file"
+	ruleNegativeSubject = "negative_subject"
+)
+
+var attachmentRules = []string{ruleDocumentType, ruleImageType, ruleSmallFile, ruleNegativeSubject}
+
+// defaultWeights: a name match alone downloads, subject, group address and
+// body need a document type, negative weights pull the score down
+var defaultWeights = map[string]float64{
+	ruleFilename:        1.0,
+	ruleSubject:         0.8,
+	ruleGroup:           0.8,
+	ruleBody:            0.8,
+	ruleSenderDomain:    0.5,
+	ruleDocumentType:    0.2,
+	ruleImageType:       -0.5,
+	ruleSmallFile:       -0.5,
+	ruleNegativeSubject: -1.0,
+}
+
+// defaultKeywordWeights: generic words also fill account notices and
+// newsletters ("Your account balance"), so they only reach the review queue
+// with a document unless another rule agrees; other keywords weigh the full
+// subject weight. A lower configured subject weight caps these too.
+var defaultKeywordWeights = map[string]float64{
+	"account":      0.5,
+	"balance":      0.5,
+	"statement":    0.5,
+	"due":          0.5,
+	"overdue":      0.5,
+	"transaction":  0.5,
+	"transfer":     0.5,
+	"subscription": 0.5,
+	"renewal":      0.5,
+}
+
+// Subject phrases that mark an invoice from any sender, on top of the
+// configured keywords; they weigh the full subject weight
+var invoiceSubjectPhrases = []string{"you have a new", "new invoice"}
+
+// Scores at or above the download threshold are downloaded, scores between
+// the review and the download threshold go to the review queue
+const (
+	defaultDownloadThreshold = 1.0
+	defaultReviewThreshold   = 0.5
+)
+
+// Encoded size below which an attachment is likely a logo or a tracking file
+const smallAttachmentBytes = 2 * 1024
+
+// Lower case subject words of newsletters and marketing mail
+var negativeSubjectWords = []string{"newsletter", "webinar", "digest", "announcement", "promotion"}
+
+// MIME types and extensions of invoice documents
+var documentTypes = []string{
+	"application/pdf", "application/vnd.ms-excel",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/msword", "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"text/csv",
+}
+
+var documentExtensions = []string{".pdf", ".xls", ".xlsx", ".doc", ".docx", ".csv", ".odt", ".ods"}
+
+// Folder policy key for folders without their own entry
+const defaultFolderPolicy = "*"
+
+// defaultFolderPolicies: INBOX uses every rule, All Mail and label folders
+// only trust attachment names
+var defaultFolderPolicies = map[string][]string{
+	"INBOX":             {ruleFilename, ruleSubject, ruleGroup, ruleBody, ruleSenderDomain},
+	defaultFolderPolicy: {ruleFilename},
+}
+
+// classifiedMessage is what the classifier sees of a message
+type classifiedMessage struct {
+	folder    string
+	envelope  *imap.Envelope
+	structure *imap.BodyStructure
+	// Lower case start of the text parts, empty when not fetched
+	bodySnippet string
+}
+
+// newClassifiedMessage prepares a fetched message for classification
+func newClassifiedMessage(msg *imap.Message, folder string) classifiedMessage {
+	return classifiedMessage{
+		folder:    folder,
+		envelope:  msg.Envelope,
+		structure: msg.BodyStructure,
+	}
+}
+
+// Rule name of reasons that reject an attachment before any rule is checked
+const ruleExclude = "exclude"
+
+// reason is the outcome of one rule for one attachment, kept in the index and
+// the run report so every decision can be explained later
+type reason struct {
+	Rule    string `json:"rule"`
+	Matched bool   `json:"matched"`
+	// Weight added to the score when matched
+	Weight float64 `json:"weight,omitempty"`
+	Detail string  `json:"detail,omitempty"`
+}
+
+func (r reason) String() string {
+	mark := "✗"
+	if r.Matched {
+		mark = "✓"
+	}
+	rule := r.Rule
+	if r.Matched && r.Weight != 0 {
+		rule = fmt.Sprintf("%s (%+.2f)", r.Rule, r.Weight)
+	}
+	if r.Detail == "" {
+		return fmt.Sprintf("%s %s", mark, rule)
+	}
+	return fmt.Sprintf("%s %s: %s", mark, rule, r.Detail)
+}
+
+// score sums the weights of the matched reasons
+func score(reasons []reason) float64 {
+	total := 0.0
+	for _, r := range reasons {
+		if r.Matched {
+			total += r.Weight
+		}
+	}
+	// Two decimals, so 0.8 + 0.2 reaches a threshold of 1
+	return math.Round(total*100) / 100
+}
+
+// attachmentDecision is the verdict on one attachment of a message
+type attachmentDecision struct {
+	attachment attachmentInfo
+	score      float64
+	download   bool
+	// Between the thresholds: queued for a person to decide
+	review bool
+	// Rejected by an exclusion rule, no other rule was checked
+	excluded bool
+	// Every rule checked, matched or not
+	reasons []reason
+}
+
+// Classifier decides which attachments to download, the same way for every
+// folder; the folder only selects which rules apply
+type Classifier struct {
+	keywords  []string
+	userEmail string
+	policies  map[string][]string
+	weights   map[string]float64
+	// Subject weight of single keywords, by lower case keyword
+	keywordWeights map[string]float64
+	exclude        *ExcludeRules
+	// Score needed for a download and for the review queue
+	downloadThreshold float64
+	reviewThreshold   float64
+}
+
+// newClassifier builds the classifier of an account from the configured
+// folder policies, which override the defaults folder by folder
+func newClassifier(config *Config, account *Account) (*Classifier, error) {
+	policies := make(map[string][]string)
+	for folder, rules := range defaultFolderPolicies {
+		policies[folder] = rules
+	}
+	for folder, rules := range config.FolderPolicies {
+		for _, rule := range rules {
+			if !isKnownRule(rule) {
+				return nil, fmt.Errorf("folder policy %q: unknown rule %q (known: %s)", folder, rule, strings.Join(knownRules, ", "))
+			}
+		}
+		if strings.EqualFold(folder, "INBOX") {
+			folder = "INBOX"
+		}
+		policies[folder] = rules
+	}
+	
+	weights := make(map[string]float64)
+	for rule, weight := range defaultWeights {
+		weights[rule] = weight
+	}
+	for rule, weight := range config.ScoreWeights {
+		if _, ok := defaultWeights[rule]; !ok {
+			return nil, fmt.Errorf("score weight for unknown rule %q (known: %s)", rule, strings.Join(append(knownRules, attachmentRules...), ", "))
+		}
+		weights[rule] = weight
+	}
+	
+	keywordWeights := make(map[string]float64)
+	for keyword, weight := range defaultKeywordWeights {
+		keywordWeights[keyword] = min(weight, weights[ruleSubject])
+	}
+	for keyword, weight := range config.KeywordWeights {
+		known := false
+		for _, configured := range config.Keywords {
+			known = known || strings.EqualFold(keyword, configured)
+		}
+		if !known {
+			return nil, fmt.Errorf("keyword weight for %q, which is not in keywords", keyword)
+		}
+		keywordWeights[strings.ToLower(keyword)] = weight
+	}
+	
+	downloadThreshold := defaultDownloadThreshold
+	if config.DownloadThreshold != 0 {
+		downloadThreshold = config.DownloadThreshold
+	}
+	reviewThreshold := defaultReviewThreshold
+	if config.ReviewThreshold != 0 {
+		reviewThreshold = config.ReviewThreshold
+	}
+	if reviewThreshold > downloadThreshold {
+		return nil, fmt.Errorf("review threshold %.2f is above download threshold %.2f", reviewThreshold, downloadThreshold)
+	}
+	
+	exclude, err := newExcludeRules(config)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &Classifier{
+		keywords:          config.Keywords,
+		userEmail:         account.Email,
+		policies:          policies,
+		weights:           weights,
+		keywordWeights:    keywordWeights,
+		exclude:           exclude,
+		downloadThreshold: downloadThreshold,
+		reviewThreshold:   reviewThreshold,
+	}, nil
+}
+
+func isKnownRule(rule string) bool {
+	for _, known := range knownRules {
+		if rule == known {
+			return true
+		}
+	}
+	return false
+}
+
+// rules returns the rules enabled for a folder
+func (cl *Classifier) rules(folder string) map[string]bool {
+	rules, ok := cl.policies[folder]
+	if !ok {
+		rules = cl.policies[defaultFolderPolicy]
+	}
+	
+	enabled := make(map[string]bool)
+	for _, rule := range rules {
+		enabled[rule] = true
+	}
+	for _, rule := range attachmentRules {
+		enabled[rule] = true
+	}
+	return enabled
+}
+
+// needsBody reports whether the body could still qualify an attachment that
+// the envelope and names do not, or exclude one they do, so text parts are
+// only fetched when useful
+func (cl *Classifier) needsBody(msg classifiedMessage) bool {
+	bodyWeight := 0.0
+	if cl.rules(msg.folder)[ruleBody] {
+		bodyWeight = cl.weights[ruleBody]
+	}
+	for _, decision := range cl.classify(msg) {
+		if decision.excluded {
+			continue
+		}
+		if len(cl.exclude.Body) > 0 && (decision.download || decision.review) {
+			return true
+		}
+		if bodyWeight > 0 && !decision.download && decision.score+bodyWeight >= cl.reviewThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// classify returns a decision for every attachment of the message
+func (cl *Classifier) classify(msg classifiedMessage) []attachmentDecision {
+	rules := cl.rules(msg.folder)
+	
+	// Message-level signals
+	env := msg.envelope
+	if env == nil {
+		env = &imap.Envelope{}
+	}
+	var messageReasons []reason
+	keyword, keywordWeight := cl.subjectKeyword(env.Subject)
+	subject := cl.check(rules, ruleSubject, func() (string, string) {
+		if keyword != "" {
+			return fmt.Sprintf("keyword %q in %q", keyword, env.Subject), ""
+		}
+		if match := invoiceSubjectMatch(env.Subject); match != "" {
+			return fmt.Sprintf("%s in %q", match, env.Subject), ""
+		}
+		return "", fmt.Sprintf("no keyword in %q", env.Subject)
+	})
+	if subject.Matched && keyword != "" {
+		subject.Weight = keywordWeight
+	}
+	messageReasons = append(messageReasons, subject)
+	messageReasons = append(messageReasons, cl.check(rules, ruleGroup, func() (string, string) {
+		if group := sentToGroup(env, cl.userEmail); group != "" {
+			return fmt.Sprintf("sent to %s", group), ""
+		}
+		return "", "not sent to a group address"
+	}))
+	messageReasons = append(messageReasons, cl.check(rules, ruleBody, func() (string, string) {
+		if msg.bodySnippet == "" {
+			return "", "body not scanned"
+		}
+		if vendor, pattern := vendorPattern(msg.bodySnippet, func(v *Vendor) []string { return v.BodyPatterns }); vendor != nil {
+			return fmt.Sprintf("%s pattern %q", vendor.ID, pattern), ""
+		}
+		return "", "no vendor pattern"
+	}))
+	messageReasons = append(messageReasons, cl.check(rules, ruleSenderDomain, func() (string, string) {
+		from := ""
+		if len(env.From) > 0 && env.From[0] != nil {
+			from = env.From[0].Address()
+		}
+		if service := detectServiceFromEmail(from); service != "" {
+			return fmt.Sprintf("%s is a %s domain", from, service), ""
+		}
+		return "", fmt.Sprintf("%s is not a vendor domain", from)
+	}))
+	messageReasons = append(messageReasons, cl.check(rules, ruleNegativeSubject, func() (string, string) {
+		lower := strings.ToLower(env.Subject)
+		for _, word := range negativeSubjectWords {
+			if strings.Contains(lower, word) {
+				return fmt.Sprintf("%q in subject", word), ""
+			}
+		}
+		return "", ""
+	}))
+	
+	// Exclusions apply in every folder, before any rule is weighed
+	messageExclusion := cl.exclude.messageExclusion(env, msg.bodySnippet)
+	
+	var decisions []attachmentDecision
+	for _, attachment := range findAttachments(msg.structure, []string{}) {
+		decision := attachmentDecision{attachment: attachment}
+		
+		exclusion := messageExclusion
+		if exclusion == "" {
+			exclusion = cl.exclude.attachmentExclusion(attachment)
+		}
+		if exclusion != "" {
+			decision.excluded = true
+			decision.reasons = []reason{{Rule: ruleExclude, Matched: true, Detail: exclusion}}
+			decisions = append(decisions, decision)
+			continue
+		}
+		
+		decision.reasons = append(decision.reasons, cl.check(rules, ruleFilename, func() (string, string) {
+			if match := invoiceFileMatch(attachment.filename, cl.keywords); match != "" {
+				return match, ""
+			}
+			return "", fmt.Sprintf("no match in %q", attachment.filename)
+		}))
+		decision.reasons = append(decision.reasons, messageReasons...)
+		decision.reasons = append(decision.reasons, cl.check(rules, ruleDocumentType, func() (string, string) {
+			if isDocument(attachment) {
+				return attachment.mimeType, ""
+			}
+			return "", attachment.mimeType
+		}))
+		decision.reasons = append(decision.reasons, cl.check(rules, ruleImageType, func() (string, string) {
+			if strings.HasPrefix(attachment.mimeType, "image/") {
+				return attachment.mimeType, ""
+			}
+			return "", ""
+		}))
+		decision.reasons = append(decision.reasons, cl.check(rules, ruleSmallFile, func() (string, string) {
+			if attachment.size > 0 && attachment.size < smallAttachmentBytes {
+				return fmt.Sprintf("%d bytes", attachment.size), ""
+			}
+			return "", fmt.Sprintf("%d bytes", attachment.size)
+		}))
+		
+		decision.score = score(decision.reasons)
+		decision.download = decision.score >= cl.downloadThreshold
+		decision.review = !decision.download && decision.score >= cl.reviewThreshold
+		decisions = append(decisions, decision)
+	}
+	return decisions
+}
+
+// check runs one rule unless the folder policy disables it; test returns the
+// detail of a match or of a miss
+func (cl *Classifier) check(rules map[string]bool, rule string, test func() (matched, missed string)) reason {
+	if !rules[rule] {
+		return reason{Rule: rule, Detail: "disabled by folder policy"}
+	}
+	matched, missed := test()
+	if matched != "" {
+		return reason{Rule: rule, Matched: true, Weight: cl.weights[rule], Detail: matched}
+	}
+	return reason{Rule: rule, Detail: missed}
+}
+
+// subjectKeyword returns the keyword or invoice phrase of the subject with the
+// highest weight and that weight, or "" when none matches
+func (cl *Classifier) subjectKeyword(subject string) (string, float64) {
+	best, bestWeight := "", 0.0
+	for _, keyword := range append(append([]string{}, cl.keywords...), invoiceSubjectPhrases...) {
+		if matchKeyword(subject, []string{keyword}) == "" {
+			continue
+		}
+		weight, ok := cl.keywordWeights[strings.ToLower(keyword)]
+		if !ok {
+			weight = cl.weights[ruleSubject]
+		}
+		if best == "" || weight > bestWeight {
+			best, bestWeight = keyword, weight
+		}
+	}
+	return best, bestWeight
+}
+
+// isDocument reports whether an attachment is an invoice document type, by
+// MIME type or, for application/octet-stream, by extension
+func isDocument(attachment attachmentInfo) bool {
+	for _, mimeType := range documentTypes {
+		if attachment.mimeType == mimeType {
+			return true
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(attachment.filename))
+	for _, documentExt := range documentExtensions {
+		if ext == documentExt {
+			return true
+		}
+	}
+	return false
+}
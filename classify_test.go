@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// testClassifiedMessage is an INBOX message from a non-vendor sender with
+// one attachment of the given name and MIME type
+func testClassifiedMessage(subject, filename, mimeType string) classifiedMessage {
+	mainType, subType, _ := strings.Cut(mimeType, "/")
+	return classifiedMessage{
+		folder: "INBOX",
+		envelope: &imap.Envelope{
+			Subject: subject,
+			From:    []*imap.Address{{MailboxName: "news", HostName: "bank.example"}},
+		},
+		structure: &imap.BodyStructure{
+			MIMEType:    "multipart",
+			MIMESubType: "mixed",
+			Parts: []*imap.BodyStructure{
+				{MIMEType: "text", MIMESubType: "plain", Size: 100},
+				{
+					MIMEType:          mainType,
+					MIMESubType:       subType,
+					Disposition:       "attachment",
+					DispositionParams: map[string]string{"filename": filename},
+					Encoding:          "base64",
+					Size:              40000,
+				},
+			},
+		},
+	}
+}
+
+func TestClassifyKeywordWeights(t *testing.T) {
+	tests := []struct {
+		subject        string
+		filename       string
+		mimeType       string
+		scoreWeights   map[string]float64
+		keywordWeights map[string]float64
+		score          float64
+		download       bool
+		review         bool
+	}{
+		{"Your invoice", "document.pdf", "application/pdf", nil, nil, 1.0, true, false},
+		{"Your account balance", "document.pdf", "application/pdf", nil, nil, 0.7, false, true},
+		{"Invoice for your account", "document.pdf", "application/pdf", nil, nil, 1.0, true, false},
+		{"Monthly statement", "document.pdf", "application/pdf", nil, map[string]float64{"Statement": 0.8}, 1.0, true, false},
+		{"Your invoice", "document.pdf", "application/pdf", nil, map[string]float64{"invoice": 0.2}, 0.4, false, false},
+		// A lower subject weight caps the generic keywords as well
+		{"Your account balance", "document.pdf", "application/pdf", map[string]float64{"subject": 0.3}, nil, 0.5, false, true},
+		{"Your invoice", "document.pdf", "application/pdf", map[string]float64{"subject": 0.3}, nil, 0.5, false, true},
+		// The receipt's name carries a receipt image with a generic subject
+		{"Your account statement", "receipt_0815.jpg", "image/jpeg", nil, nil, 1.0, true, false},
+		{"Your invoice", "receipt_0815.jpg", "image/jpeg", nil, nil, 1.3, true, false},
+		// Invoice phrases of any sender weigh the full subject weight
+		{"You have a new document", "document.pdf", "application/pdf", nil, nil, 1.0, true, false},
+	}
+	
+	for _, tt := range tests {
+		config := testConfig()
+		config.Keywords = defaultKeywords
+		config.ScoreWeights = tt.scoreWeights
+		config.KeywordWeights = tt.keywordWeights
+		cl, err := newClassifier(config, &config.Account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decisions := cl.classify(testClassifiedMessage(tt.subject, tt.filename, tt.mimeType))
+		if len(decisions) != 1 {
+			t.Fatalf("%q: %d decisions, want 1", tt.subject, len(decisions))
+		}
+		d := decisions[0]
+		if d.score != tt.score || d.download != tt.download || d.review != tt.review {
+			t.Errorf("%q %s with %v %v: score %.2f, download %v review %v, want %.2f, %v, %v",
+				tt.subject, tt.filename, tt.scoreWeights, tt.keywordWeights, d.score, d.download, d.review, tt.score, tt.download, tt.review)
+		}
+	}
+}
+
+func TestClassifierRejectsWeightOfUnknownKeyword(t *testing.T) {
+	config := testConfig()
+	config.KeywordWeights = map[string]float64{"newsletter": 0.1}
+	if _, err := newClassifier(config, &config.Account); err == nil {
+		t.Error("weight of a keyword that is not configured was accepted")
+	}
+}
+
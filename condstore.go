@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// CONDSTORE (RFC 7162) lets a run find messages whose flags or labels changed
+// since the previous run, not only messages with new UIDs.
+
+const statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+
+func supportsCondStore(c *client.Client) bool {
+	ok, err := c.Support("CONDSTORE")
+	return err == nil && ok
+}
+
+// highestModSeq returns the folder's HIGHESTMODSEQ, or 0 if the server does not report one
+func highestModSeq(c *client.Client, folder string) uint64 {
+	status, err := c.Status(folder, []imap.StatusItem{statusHighestModSeq})
+	if err != nil {
+		return 0
+	}
+	
+	value, ok := status.Items[statusHighestModSeq]
+	if !ok || value == nil {
+		return 0
+	}
+	modSeq, err := strconv.ParseUint(fmt.Sprint(value), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return modSeq
+}
+
+// searchChangedUids returns already processed UIDs (up to saved.LastUid) whose
+// MODSEQ is above the one saved by the previous run
+func searchChangedUids(c *client.Client, query searchQuery, saved *folderState) ([]uint32, error) {
+	uidRange := new(imap.SeqSet)
+	uidRange.AddRange(1, saved.LastUid)
+	
+	modSeq := strconv.FormatUint(saved.HighestModSeq+1, 10)
+	return uidSearch(c, query.withUids(uidRange), imap.RawString("MODSEQ"), imap.RawString(modSeq))
+}
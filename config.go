@@ -11,20 +11,135 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
 )
 
+// Account is one mailbox to collect invoices from
+type Account struct {
+	Name              string       `json:"name,omitempty"`
+	Email             string       `json:"email"`
+	Server            string       `json:"server"`
+	Port              string       `json:"port"`
+	Provider          string       `json:"provider,omitempty"`
+	EncryptedPassword string       `json:"encrypted_password"`
+	PasswordSource    string       `json:"password_source,omitempty"`
+	PasswordEnv       string       `json:"password_env,omitempty"`
+	PasswordFile      string       `json:"password_file,omitempty"`
+	PasswordCommand   string       `json:"password_command,omitempty"`
+	AuthMethod        string       `json:"auth_method,omitempty"`
+	OAuth             *OAuthConfig `json:"oauth,omitempty"`
+}
+
+// Config holds either a single top-level account (the original layout)
+// or a list of named accounts, plus settings shared by all of them
 type Config struct {
-	Email             string   `json:"email"`
-	Server            string   `json:"server"`
-	Port              string   `json:"port"`
-	EncryptedPassword string   `json:"encrypted_password"`
-	Keywords          []string `json:"keywords"`
+	Account
+	Accounts          []Account           `json:"accounts,omitempty"`
+	KeySalt           string              `json:"key_salt,omitempty"`
+	KeyVersion        int                 `json:"key_version,omitempty"`
+	Keywords          []string            `json:"keywords"`
+	// First month of the fiscal year (1-12) used by -year, January when unset
+	FiscalYearStart   int                 `json:"fiscal_year_start,omitempty"`
+	// IANA timezone for period boundaries (e.g. "Europe/Berlin"), local time when unset
+	Timezone          string              `json:"timezone,omitempty"`
+	// Download index file, invoice_index.jsonl next to the output folder when unset
+	IndexFile         string              `json:"index_file,omitempty"`
+	// Bytes of each text part fetched for body scanning, 32 KiB when unset
+	BodyScanBytes     int                 `json:"body_scan_bytes,omitempty"`
+	// Rules that may qualify attachments, by folder name or "*" for all other folders
+	FolderPolicies    map[string][]string `json:"folder_policies,omitempty"`
+	// Score weights by rule, overriding the defaults of classify.go
+	ScoreWeights      map[string]float64  `json:"score_weights,omitempty"`
+	// Subject weight of single keywords, overriding the defaults of classify.go
+	KeywordWeights    map[string]float64  `json:"keyword_weights,omitempty"`
+	// Score needed for a download, 1.0 when unset
+	DownloadThreshold float64             `json:"download_threshold,omitempty"`
+	// Score needed for the review queue, 0.5 when unset
+	ReviewThreshold   float64             `json:"review_threshold,omitempty"`
+	// Keywords, senders and MIME types never downloaded, on top of the "invite" rule
+	Exclude           *ExcludeRules       `json:"exclude,omitempty"`
+	// Vendor registry overlay, vendors.json in the working directory when unset
+	VendorFile        string              `json:"vendor_file,omitempty"`
+
+	// Derived encryption key, cached after the first passphrase prompt
+	key []byte
 }
 
-func loadConfig() *Config {
-	configFile := "config.json"
+// Default number of bytes of each text part fetched for body scanning
+const defaultBodyScanBytes = 32 * 1024
+
+// bodyScanLimit is how much of each text part classification reads
+func (config *Config) bodyScanLimit() int {
+	if config.BodyScanBytes > 0 {
+		return config.BodyScanBytes
+	}
+	return defaultBodyScanBytes
+}
+
+// Value of -account selecting every configured account
+const allAccounts = "all"
+
+// label is the account name used in output and the manifest
+func (a *Account) label() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.Email
+}
+
+// accounts returns the configured accounts, the top-level one for single-account configs
+func (config *Config) accounts() []*Account {
+	if len(config.Accounts) == 0 {
+		return []*Account{&config.Account}
+	}
+	
+	accounts := make([]*Account, len(config.Accounts))
+	for i := range config.Accounts {
+		accounts[i] = &config.Accounts[i]
+	}
+	return accounts
+}
+
+// selectAccounts resolves the -account flag: a name, an email, or "all"
+func (config *Config) selectAccounts(name string) ([]*Account, error) {
+	accounts := config.accounts()
+	if name == "" || name == allAccounts {
+		return accounts, nil
+	}
 	
+	for _, account := range accounts {
+		if account.Name == name || strings.EqualFold(account.Email, name) {
+			return []*Account{account}, nil
+		}
+	}
+	
+	return nil, fmt.Errorf("account %q not found in configuration", name)
+}
+
+// Key version 2: scrypt(passphrase, key_salt) + AES-256-GCM.
+// Configs without key_version use the legacy MD5(email) + AES-CFB scheme.
+const currentKeyVersion = 2
+
+const (
+	scryptN    = 1 << 15
+	scryptR    = 8
+	scryptP    = 1
+	saltSize   = 16
+	keySize    = 32
+	configFile = "config.json"
+)
+
+// Environment variable holding the master passphrase
+const passphraseEnv = "INVOICE_SEARCHER_PASSPHRASE"
+
+// File descriptor to read the master passphrase from (-passphrase-fd), -1 if unset
+var passphraseFD = -1
+
+func loadConfig() *Config {
 	// Check if configuration file exists
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
 		return createNewConfig(configFile)
@@ -43,49 +158,83 @@ func loadConfig() *Config {
 		return createNewConfig(configFile)
 	}
 	
-	fmt.Printf("Using saved configuration for %s\n", config.Email)
+	applyProviderPresets(&config)
+	
+	for _, account := range config.accounts() {
+		if err := checkAuthMethod(account.AuthMethod); err != nil {
+			fmt.Printf("Configuration error for %s: %v\n", account.label(), err)
+			os.Exit(1)
+		}
+	}
+	
+	// One-time migration of passwords encrypted with the legacy key
+	if config.KeyVersion < currentKeyVersion && hasEncryptedPasswords(&config) {
+		if err := migratePassword(&config); err != nil {
+			fmt.Printf("Password migration error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := saveConfig(&config, configFile); err != nil {
+			fmt.Printf("Configuration save error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Encrypted password migrated to passphrase-based key\n")
+	}
+	
+	if len(config.Accounts) > 0 {
+		fmt.Printf("Using saved configuration with %d accounts\n", len(config.Accounts))
+	} else {
+		fmt.Printf("Using saved configuration for %s\n", config.Email)
+	}
 	return &config
 }
 
+// Keywords of a new configuration; generic ones have lower weights, see
+// defaultKeywordWeights
+var defaultKeywords = []string{
+	"invoice", "bill", "receipt", "payment", "transaction",
+	"charge", "settlement", "remittance", "transfer", "refund",
+	"statement", "account", "balance", "due", "overdue",
+	"paid", "unpaid", "billing", "subscription", "renewal",
+}
+
 func createNewConfig(configFile string) *Config {
 	config := &Config{
-		Server: "imap.gmail.com",
-		Port:   "993",
-		Keywords: []string{
-			"invoice", "bill", "receipt", "payment", "transaction",
-			"charge", "settlement", "remittance", "transfer", "refund",
-			"statement", "account", "balance", "due", "overdue",
-			"paid", "unpaid", "billing", "subscription", "renewal",
+		Account: Account{
+			Server: "imap.gmail.com",
+			Port:   "993",
 		},
+		Keywords: append([]string{}, defaultKeywords...),
 	}
 	
-	scanner := bufio.NewScanner(os.Stdin)
-	
 	fmt.Print("Email: ")
-	scanner.Scan()
-	config.Email = scanner.Text()
-	
-	fmt.Print("Gmail App Password: ")
-	scanner.Scan()
-	password := scanner.Text()
+	config.Email = readLine()
 	
-	// Encrypt password
-	encryptedPassword, err := encryptPassword(password, config.Email)
+	fmt.Print("Gmail App Password (empty to use password_source): ")
+	password, err := readSecret()
 	if err != nil {
-		fmt.Printf("Password encryption error: %v\n", err)
+		fmt.Printf("Password read error: %v\n", err)
 		os.Exit(1)
 	}
-	config.EncryptedPassword = encryptedPassword
 	
-	// Save configuration
-	data, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		fmt.Printf("Configuration serialization error: %v\n", err)
-		return config
+	// Empty password: credentials come from password_source (env, file, command)
+	if password == "" {
+		fmt.Printf("No password stored, set password_source in %s\n", configFile)
+	} else {
+		// Encrypt password with a key derived from the master passphrase
+		if err := newPasswordKey(config); err != nil {
+			fmt.Printf("Passphrase error: %v\n", err)
+			os.Exit(1)
+		}
+		encryptedPassword, err := encryptPassword(password, config.key)
+		if err != nil {
+			fmt.Printf("Password encryption error: %v\n", err)
+			os.Exit(1)
+		}
+		config.EncryptedPassword = encryptedPassword
 	}
 	
-	err = os.WriteFile(configFile, data, 0600)
-	if err != nil {
+	// Save configuration
+	if err := saveConfig(config, configFile); err != nil {
 		fmt.Printf("Configuration save error: %v\n", err)
 	} else {
 		fmt.Printf("Configuration saved to %s\n", configFile)
@@ -94,32 +243,246 @@ func createNewConfig(configFile string) *Config {
 	return config
 }
 
-func encryptPassword(password, key string) (string, error) {
-	// Use MD5 hash of key as AES key
-	hash := md5.New()
-	hash.Write([]byte(key))
-	keyBytes := hash.Sum(nil)
+func saveConfig(config *Config, configFile string) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("configuration serialization error: %v", err)
+	}
 	
-	block, err := aes.NewCipher(keyBytes)
+	return os.WriteFile(configFile, data, 0600)
+}
+
+// newPasswordKey generates a fresh salt and derives the key from a new passphrase
+func newPasswordKey(config *Config) error {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	
+	passphrase, err := readPassphrase(true)
+	if err != nil {
+		return err
+	}
+	
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	
+	config.KeySalt = base64.StdEncoding.EncodeToString(salt)
+	config.KeyVersion = currentKeyVersion
+	config.key = key
+	return nil
+}
+
+// passwordKey returns the key for the stored password, asking for the passphrase once per run
+func passwordKey(config *Config) ([]byte, error) {
+	if config.key != nil {
+		return config.key, nil
+	}
+	
+	salt, err := base64.StdEncoding.DecodeString(config.KeySalt)
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("invalid key salt in configuration")
+	}
+	
+	passphrase, err := readPassphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	
+	config.key = key
+	return key, nil
+}
+
+// encryptSecret encrypts a value for config.json, creating the passphrase key if needed
+func encryptSecret(config *Config, secret string) (string, error) {
+	if config.KeySalt == "" {
+		if err := newPasswordKey(config); err != nil {
+			return "", err
+		}
+	}
+	
+	key, err := passwordKey(config)
 	if err != nil {
 		return "", err
 	}
+	return encryptPassword(secret, key)
+}
+
+func decryptSecret(config *Config, encrypted string) (string, error) {
+	key, err := passwordKey(config)
+	if err != nil {
+		return "", fmt.Errorf("passphrase error: %v", err)
+	}
+	return decryptPassword(encrypted, key)
+}
+
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase cannot be empty")
+	}
+	return scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, keySize)
+}
+
+// readPassphrase gets the master passphrase from the environment, the
+// -passphrase-fd descriptor or an interactive prompt, in that order
+func readPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
 	
-	plaintext := []byte(password)
-	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
-	iv := ciphertext[:aes.BlockSize]
+	if passphraseFD >= 0 {
+		file := os.NewFile(uintptr(passphraseFD), "passphrase-fd-"+strconv.Itoa(passphraseFD))
+		if file == nil {
+			return "", fmt.Errorf("invalid passphrase file descriptor %d", passphraseFD)
+		}
+		defer file.Close()
+		
+		line, err := bufio.NewReader(file).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("passphrase read error: %v", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
 	
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	fmt.Print("Master passphrase: ")
+	passphrase, err := readSecret()
+	if err != nil {
 		return "", err
 	}
 	
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
+	if confirm {
+		fmt.Print("Repeat master passphrase: ")
+		repeated, err := readSecret()
+		if err != nil {
+			return "", err
+		}
+		if repeated != passphrase {
+			return "", fmt.Errorf("passphrases do not match")
+		}
+	}
+	
+	return passphrase, nil
+}
+
+// Standard input shared by all prompts, so piped answers are not lost
+// to the buffer of an earlier prompt
+var stdin = bufio.NewReader(os.Stdin)
+
+// readLine reads one answer from standard input without the line ending
+func readLine() string {
+	line, _ := stdin.ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
+
+// readSecret reads an answer without echo when standard input is a terminal
+func readSecret() (string, error) {
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		secret, err := term.ReadPassword(fd)
+		fmt.Println()
+		return string(secret), err
+	}
+	return readLine(), nil
+}
+
+func hasEncryptedPasswords(config *Config) bool {
+	for _, account := range config.accounts() {
+		if account.EncryptedPassword != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// migratePassword re-encrypts legacy MD5(email) passwords with a passphrase-based key
+func migratePassword(config *Config) error {
+	passwords := make(map[*Account]string)
+	for _, account := range config.accounts() {
+		if account.EncryptedPassword == "" {
+			continue
+		}
+		password, err := decryptLegacyPassword(account.EncryptedPassword, account.Email)
+		if err != nil {
+			return fmt.Errorf("legacy password decryption error for %s: %v", account.label(), err)
+		}
+		passwords[account] = password
+	}
+	
+	fmt.Printf("Stored password uses the legacy key, choose a master passphrase to protect it\n")
+	if err := newPasswordKey(config); err != nil {
+		return err
+	}
+	
+	for account, password := range passwords {
+		encryptedPassword, err := encryptPassword(password, config.key)
+		if err != nil {
+			return err
+		}
+		account.EncryptedPassword = encryptedPassword
+	}
+	
+	return nil
+}
+
+func encryptPassword(password string, key []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	
+	// Nonce is stored in front of the sealed password
+	ciphertext := gcm.Seal(nonce, nonce, []byte(password), nil)
 	
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
-func decryptPassword(encryptedPassword, key string) (string, error) {
+func decryptPassword(encryptedPassword string, key []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	
+	ciphertext, err := base64.StdEncoding.DecodeString(encryptedPassword)
+	if err != nil {
+		return "", err
+	}
+	
+	if len(ciphertext) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted password too short")
+	}
+	
+	nonce := ciphertext[:gcm.NonceSize()]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("wrong passphrase or corrupted password")
+	}
+	
+	return string(plaintext), nil
+}
+
+// decryptLegacyPassword decrypts passwords written before key version 2
+func decryptLegacyPassword(encryptedPassword, key string) (string, error) {
 	// Use MD5 hash of key as AES key
 	hash := md5.New()
 	hash.Write([]byte(key))
@@ -149,8 +512,6 @@ func decryptPassword(encryptedPassword, key string) (string, error) {
 }
 
 func getMonthInput() string {
-	scanner := bufio.NewScanner(os.Stdin)
 	fmt.Print("Month (YYYY-MM, e.g. 2025-09): ")
-	scanner.Scan()
-	return strings.TrimSpace(scanner.Text())
+	return strings.TrimSpace(readLine())
 }
\ No newline at end of file
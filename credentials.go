@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// CredentialProvider supplies the IMAP password
+type CredentialProvider interface {
+	Password() (string, error)
+}
+
+// Values for Config.PasswordSource
+const (
+	passwordSourceEncrypted = "encrypted"
+	passwordSourceEnv       = "env"
+	passwordSourceFile      = "file"
+	passwordSourceCommand   = "command"
+)
+
+// Default environment variable for the "env" password source
+const defaultPasswordEnv = "INVOICE_SEARCHER_PASSWORD"
+
+const passwordCommandTimeout = 30 * time.Second
+
+func newCredentialProvider(config *Config, account *Account) (CredentialProvider, error) {
+	switch account.PasswordSource {
+	case "", passwordSourceEncrypted:
+		return &encryptedCredentials{config: config, account: account}, nil
+	case passwordSourceEnv:
+		name := account.PasswordEnv
+		if name == "" {
+			name = defaultPasswordEnv
+		}
+		return &envCredentials{name: name}, nil
+	case passwordSourceFile:
+		if account.PasswordFile == "" {
+			return nil, fmt.Errorf("password_file is not set")
+		}
+		return &fileCredentials{path: account.PasswordFile}, nil
+	case passwordSourceCommand:
+		if account.PasswordCommand == "" {
+			return nil, fmt.Errorf("password_command is not set")
+		}
+		return &commandCredentials{command: account.PasswordCommand}, nil
+	}
+	
+	return nil, fmt.Errorf("unknown password source %q", account.PasswordSource)
+}
+
+// encryptedCredentials decrypts encrypted_password with the master passphrase key
+type encryptedCredentials struct {
+	config  *Config
+	account *Account
+}
+
+func (p *encryptedCredentials) Password() (string, error) {
+	if p.account.EncryptedPassword == "" {
+		return "", fmt.Errorf("encrypted_password is not set")
+	}
+	
+	password, err := decryptSecret(p.config, p.account.EncryptedPassword)
+	if err != nil {
+		return "", fmt.Errorf("password decryption error: %v", err)
+	}
+	
+	return password, nil
+}
+
+// envCredentials reads the password from an environment variable
+type envCredentials struct {
+	name string
+}
+
+func (p *envCredentials) Password() (string, error) {
+	password := os.Getenv(p.name)
+	if password == "" {
+		return "", fmt.Errorf("environment variable %s is empty", p.name)
+	}
+	return password, nil
+}
+
+// fileCredentials reads the password from a secrets file (e.g. a Docker or Kubernetes secret mount)
+type fileCredentials struct {
+	path string
+}
+
+func (p *fileCredentials) Password() (string, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return "", fmt.Errorf("password file read error: %v", err)
+	}
+	
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("password file %s is empty", p.path)
+	}
+	return password, nil
+}
+
+// commandCredentials runs an external command (pass, gopass, op ...) and uses its stdout
+type commandCredentials struct {
+	command string
+}
+
+func (p *commandCredentials) Password() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), passwordCommandTimeout)
+	defer cancel()
+	
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", p.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", p.command)
+	}
+	
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("password command error: %v", err)
+	}
+	
+	// Only the first line is used, as pass and gopass print metadata after it
+	password := strings.TrimRight(strings.SplitN(stdout.String(), "\n", 2)[0], "\r")
+	if password == "" {
+		return "", fmt.Errorf("password command returned nothing")
+	}
+	return password, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"path/filepath"
+	"strings"
+)
+
+// newTransferDecoder undoes the Content-Transfer-Encoding of a MIME part
+// while it is read
+func newTransferDecoder(r io.Reader, encoding string) (io.Reader, error) {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		return base64.NewDecoder(base64.RawStdEncoding, &base64Filter{r: r}), nil
+	case "quoted-printable":
+		return quotedprintable.NewReader(r), nil
+	case "", "7bit", "8bit", "binary":
+		return r, nil
+	default:
+		return nil, fmt.Errorf("unsupported transfer encoding %q", encoding)
+	}
+}
+
+// base64Filter drops the line breaks and other whitespace encoded parts are
+// split with, and the padding, which some senders leave out
+type base64Filter struct {
+	r io.Reader
+}
+
+func (f *base64Filter) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		kept := 0
+		for _, b := range p[:n] {
+			switch b {
+			case ' ', '\t', '\r', '\n', '=':
+				continue
+			}
+			p[kept] = b
+			kept++
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// fileSignatures are the leading bytes of the formats invoices come in
+var fileSignatures = map[string][]string{
+	".pdf":  {"%PDF-"},
+	".zip":  {"PK\x03\x04"},
+	".xlsx": {"PK\x03\x04"},
+	".docx": {"PK\x03\x04"},
+	".xls":  {"\xD0\xCF\x11\xE0"},
+	".doc":  {"\xD0\xCF\x11\xE0"},
+	".png":  {"\x89PNG"},
+	".jpg":  {"\xFF\xD8\xFF"},
+	".jpeg": {"\xFF\xD8\xFF"},
+	".gif":  {"GIF87a", "GIF89a"},
+	".bmp":  {"BM"},
+	".tiff": {"II*\x00", "MM\x00*"},
+}
+
+// Extensions for parts that have no filename, by MIME type
+var mimeExtensions = map[string]string{
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+}
+
+// checkFileType makes sure the start of decoded content matches the
+// attachment's file type, so a part that failed to decode is not saved as a
+// broken document
+func checkFileType(data []byte, filename string, mimeType string) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	signatures, ok := fileSignatures[ext]
+	if !ok {
+		ext = mimeExtensions[strings.ToLower(mimeType)]
+		signatures, ok = fileSignatures[ext]
+	}
+	if !ok {
+		return nil
+	}
+	
+	for _, signature := range signatures {
+		if bytes.HasPrefix(data, []byte(signature)) {
+			return nil
+		}
+	}
+	// Readers accept junk before the PDF header within the first 1024 bytes
+	if ext == ".pdf" && bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-")) {
+		return nil
+	}
+	return fmt.Errorf("content of %s does not look like a %s file", filename, strings.ToUpper(strings.TrimPrefix(ext, ".")))
+}
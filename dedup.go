@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Gmail's unique message ID, the same in every label that holds the message
+const fetchGmailMsgID imap.FetchItem = "X-GM-MSGID"
+
+// The Message-ID header alone, far smaller than the envelope
+var messageIDSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"Message-ID"}},
+	Peek:         true,
+}
+
+// Number of UIDs per lightweight ID fetch
+const idFetchBatchSize = 200
+
+// messageKey identifies a message across the folders of one account:
+// X-GM-MSGID on Gmail, Message-ID elsewhere, "" when neither is available.
+// Both are scoped to the account, so each account processes its own copy;
+// the download index skips the attachments another account already saved
+func messageKey(msg *imap.Message, account *Account) string {
+	if value, ok := msg.Items[fetchGmailMsgID]; ok && value != nil {
+		// Gmail IDs are only unique within one mailbox
+		return "gm:" + account.label() + ":" + fmt.Sprint(value)
+	}
+	if id := headerMessageID(msg); id != "" {
+		return "mid:" + account.label() + ":" + id
+	}
+	return ""
+}
+
+// headerMessageID returns the Message-ID of a fetched messageIDSection, or ""
+func headerMessageID(msg *imap.Message) string {
+	literal := msg.GetBody(messageIDSection)
+	if literal == nil {
+		return ""
+	}
+	// The section ends with the blank line after the headers; add one in case
+	// the server left it out
+	header, err := mail.ReadMessage(io.MultiReader(literal, strings.NewReader("\r\n")))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(header.Header.Get("Message-ID"))
+}
+
+// filterSeenMessages fetches only the IDs of the messages and returns the
+// UIDs not yet processed in this run, marking them as seen
+func filterSeenMessages(c *client.Client, uids []uint32, opts *searchOptions, account *Account) ([]uint32, error) {
+	if len(uids) == 0 {
+		return uids, nil
+	}
+	
+	// X-GM-MSGID is enough on Gmail, elsewhere only the Message-ID header is read
+	items := []imap.FetchItem{imap.FetchUid, messageIDSection.FetchItem()}
+	if hasGmailExtensions(c, account) {
+		items = []imap.FetchItem{imap.FetchUid, fetchGmailMsgID}
+	}
+	
+	keys := make(map[uint32]string, len(uids))
+	for i := 0; i < len(uids); i += idFetchBatchSize {
+		end := i + idFetchBatchSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+		
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uids[i:end]...)
+		
+		messages := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqset, items, messages)
+		}()
+		
+		for msg := range messages {
+			keys[msg.Uid] = messageKey(msg, account)
+		}
+		
+		if err := <-done; err != nil {
+			return nil, err
+		}
+	}
+	
+	newUids := []uint32{}
+	skipped := 0
+	for _, uid := range uids {
+		key := keys[uid]
+		if key != "" && opts.seenMessages[key] {
+			skipped++
+			continue
+		}
+		if key != "" {
+			opts.seenMessages[key] = true
+		}
+		newUids = append(newUids, uid)
+	}
+	
+	if skipped > 0 {
+		fmt.Printf("Skipped %d messages already processed in another folder\n", skipped)
+	}
+	return newUids, nil
+}
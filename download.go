@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Prefix of files still being written in the output directory
+const tempFilePrefix = ".partial-"
+
+// Temp files younger than this may belong to a run still in progress
+const staleTempFileAge = 24 * time.Hour
+
+// Bytes kept from the start of a file to check its type
+const sniffLength = 1024
+
+// headWriter keeps the first bytes written to it and discards the rest
+type headWriter struct {
+	head []byte
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if room := sniffLength - len(w.head); room > 0 {
+		w.head = append(w.head, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// streamedFile is a decoded attachment written to a temp file
+type streamedFile struct {
+	path string
+	size int64
+	hash string
+}
+
+// streamToTempFile decodes a part while copying it into a temp file in the
+// output directory and hashing it, so the content is not copied in memory
+// again. The body holds as much as its fetch returned, all of a small part or
+// one chunk of a large one (see chunkedPart). The caller commits the temp file
+// or removes it.
+func streamToTempFile(body io.Reader, encoding string, attachment attachmentInfo, outputDir string) (*streamedFile, error) {
+	decoder, err := newTransferDecoder(body, encoding)
+	if err != nil {
+		return nil, err
+	}
+	
+	tmp, err := os.CreateTemp(outputDir, tempFilePrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("file save error: %v", err)
+	}
+	
+	hasher := sha256.New()
+	sniff := &headWriter{}
+	size, err := io.Copy(io.MultiWriter(tmp, hasher, sniff), decoder)
+	if err == nil {
+		// The data must be on disk before the commit makes it look complete
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size == 0 {
+		err = fmt.Errorf("attachment is empty")
+	}
+	if err == nil {
+		err = checkFileType(sniff.head, attachment.filename, attachment.mimeType)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	
+	return &streamedFile{
+		path: tmp.Name(),
+		size: size,
+		hash: fmt.Sprintf("%x", hasher.Sum(nil)),
+	}, nil
+}
+
+// linkFile creates hard links, replaceable in tests
+var linkFile = os.Link
+
+// commitTempFile atomically gives a complete temp file its final name, so an
+// interrupted run never leaves a truncated file under a real name. Unlike a
+// rename, the link never replaces a file: when another run took the name in
+// the meantime it fails with an error matching fs.ErrExist. Filesystems
+// without hard links fall back to renameNoClobber.
+func commitTempFile(tmpPath string, filePath string) error {
+	err := linkFile(tmpPath, filePath)
+	switch {
+	case err == nil:
+		os.Remove(tmpPath)
+	case linkUnsupported(err):
+		if err := renameNoClobber(tmpPath, filePath); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	syncDir(filepath.Dir(filePath))
+	return nil
+}
+
+// renameNoClobber claims the final name with an exclusively created empty
+// file, failing like a link when it is taken, and renames the temp file over it
+func renameNoClobber(tmpPath string, filePath string) error {
+	placeholder, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	placeholder.Close()
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(filePath)
+		return err
+	}
+	return nil
+}
+
+// linkUnsupported reports whether a link error means the filesystem cannot
+// hard link, e.g. FAT, exFAT, SMB and some FUSE mounts
+func linkUnsupported(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP) ||
+		errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EXDEV)
+}
+
+// syncDir persists a new name in the directory; not every OS can sync directories
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// removeStaleTempFiles deletes temp files that interrupted runs left in the
+// given directories and returns how many were removed; recent ones are kept,
+// a concurrent run may still be writing them
+func removeStaleTempFiles(dirs []string) int {
+	removed := 0
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), tempFilePrefix) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < staleTempFileAge {
+				continue
+			}
+			if os.Remove(filepath.Join(dir, entry.Name())) == nil {
+				removed++
+			}
+		}
+	}
+	return removed
+}
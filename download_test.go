@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCommitTempFileNeverOverwrites(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, tempFilePrefix+"1")
+	final := filepath.Join(dir, "invoice.pdf")
+	if err := os.WriteFile(tmp, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(final, []byte("saved by another run"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	
+	if err := commitTempFile(tmp, final); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("commit onto an existing file: %v, want fs.ErrExist", err)
+	}
+	if data, _ := os.ReadFile(final); string(data) != "saved by another run" {
+		t.Errorf("existing file now holds %q", data)
+	}
+	
+	other := filepath.Join(dir, "invoice_1.pdf")
+	if err := commitTempFile(tmp, other); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(other); string(data) != "new" {
+		t.Errorf("committed file holds %q", data)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temp file still exists after commit: %v", err)
+	}
+}
+
+func TestRemoveStaleTempFilesKeepsRecentOnes(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, tempFilePrefix+"stale")
+	recent := filepath.Join(dir, tempFilePrefix+"recent")
+	for _, path := range []string{stale, recent} {
+		if err := os.WriteFile(path, []byte("%PDF"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-staleTempFileAge - time.Minute)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+	
+	if removed := removeStaleTempFiles([]string{dir, dir}); removed != 1 {
+		t.Errorf("removed %d temp files, want 1", removed)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale temp file kept: %v", err)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("recent temp file removed: %v", err)
+	}
+}
+
+func TestCommitTempFileWithoutHardLinks(t *testing.T) {
+	defer func(link func(string, string) error) { linkFile = link }(linkFile)
+	linkFile = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.ENOTSUP}
+	}
+	
+	dir := t.TempDir()
+	final := filepath.Join(dir, "invoice.pdf")
+	if err := os.WriteFile(final, []byte("saved by another run"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, tempFilePrefix+"1")
+	if err := os.WriteFile(tmp, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	
+	if err := commitTempFile(tmp, final); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("fallback commit onto an existing file: %v, want fs.ErrExist", err)
+	}
+	if data, _ := os.ReadFile(final); string(data) != "saved by another run" {
+		t.Errorf("existing file now holds %q", data)
+	}
+	
+	other := filepath.Join(dir, "invoice_1.pdf")
+	if err := commitTempFile(tmp, other); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(other); string(data) != "new" {
+		t.Errorf("committed file holds %q", data)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temp file still exists after commit: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// ExcludeRules reject attachments before any rule can qualify them, in every folder
+type ExcludeRules struct {
+	// Negative keywords, case-insensitive
+	Subject  []string `json:"subject,omitempty"`
+	Body     []string `json:"body,omitempty"`
+	Filename []string `json:"filename,omitempty"`
+	// Sender addresses and domains (subdomains included) never downloaded from
+	Senders       []string `json:"senders,omitempty"`
+	SenderDomains []string `json:"sender_domains,omitempty"`
+	// MIME types, "image/*" style patterns allowed
+	MIMETypes []string `json:"mime_types,omitempty"`
+}
+
+// Built-in exclusions, extended by the configured ones
+var defaultExcludeRules = ExcludeRules{
+	Filename: []string{"invite"},
+}
+
+// newExcludeRules merges the configured exclusions into the defaults
+func newExcludeRules(config *Config) (*ExcludeRules, error) {
+	rules := defaultExcludeRules
+	if ex := config.Exclude; ex != nil {
+		rules.Subject = append(append([]string{}, rules.Subject...), ex.Subject...)
+		rules.Body = append(append([]string{}, rules.Body...), ex.Body...)
+		rules.Filename = append(append([]string{}, rules.Filename...), ex.Filename...)
+		rules.Senders = append(append([]string{}, rules.Senders...), ex.Senders...)
+		rules.SenderDomains = append(append([]string{}, rules.SenderDomains...), ex.SenderDomains...)
+		rules.MIMETypes = append(append([]string{}, rules.MIMETypes...), ex.MIMETypes...)
+	}
+	
+	for _, pattern := range rules.MIMETypes {
+		if _, err := path.Match(strings.ToLower(pattern), "application/pdf"); err != nil {
+			return nil, fmt.Errorf("exclude mime type %q: %v", pattern, err)
+		}
+	}
+	return &rules, nil
+}
+
+// messageExclusion describes why every attachment of a message is excluded, or returns ""
+func (ex *ExcludeRules) messageExclusion(env *imap.Envelope, bodySnippet string) string {
+	if len(env.From) > 0 && env.From[0] != nil {
+		from := strings.ToLower(env.From[0].Address())
+		for _, sender := range ex.Senders {
+			if from == strings.ToLower(strings.TrimSpace(sender)) {
+				return fmt.Sprintf("sender %s is denied", from)
+			}
+		}
+		if at := strings.LastIndex(from, "@"); at != -1 {
+			domain := from[at+1:]
+			for _, denied := range ex.SenderDomains {
+				denied = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(denied), "@"))
+				if domain == denied || strings.HasSuffix(domain, "."+denied) {
+					return fmt.Sprintf("sender domain %s is denied", domain)
+				}
+			}
+		}
+	}
+	
+	if keyword := matchKeyword(env.Subject, ex.Subject); keyword != "" {
+		return fmt.Sprintf("subject contains %q", keyword)
+	}
+	
+	for _, keyword := range ex.Body {
+		if strings.Contains(bodySnippet, strings.ToLower(keyword)) {
+			return fmt.Sprintf("body contains %q", keyword)
+		}
+	}
+	return ""
+}
+
+// attachmentExclusion describes why an attachment is excluded, or returns ""
+func (ex *ExcludeRules) attachmentExclusion(attachment attachmentInfo) string {
+	lower := strings.ToLower(attachment.filename)
+	for _, keyword := range ex.Filename {
+		if strings.Contains(lower, strings.ToLower(keyword)) {
+			return fmt.Sprintf("filename contains %q", keyword)
+		}
+	}
+	
+	for _, pattern := range ex.MIMETypes {
+		if matched, _ := path.Match(strings.ToLower(pattern), attachment.mimeType); matched {
+			return fmt.Sprintf("MIME type %s is denied", attachment.mimeType)
+		}
+	}
+	return ""
+}
@@ -5,28 +5,62 @@ import (
 	"fmt"
 
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
 )
 
-func connectToGmail(config *Config) (*client.Client, error) {
-	// Decrypt password
-	password, err := decryptPassword(config.EncryptedPassword, config.Email)
-	if err != nil {
-		return nil, fmt.Errorf("password decryption error: %v", err)
+func connectToGmail(config *Config, account *Account) (*client.Client, error) {
+	// Resolve credentials before dialing
+	var auth sasl.Client
+	password := ""
+	switch account.AuthMethod {
+	case "", authMethodPassword:
+		// Get password from the configured source
+		provider, err := newCredentialProvider(config, account)
+		if err != nil {
+			return nil, fmt.Errorf("credential source error: %v", err)
+		}
+		password, err = provider.Password()
+		if err != nil {
+			return nil, err
+		}
+	case authMethodXOAuth2, authMethodOAuthBearer:
+		accessToken, err := oauthAccessToken(config, account)
+		if err != nil {
+			return nil, err
+		}
+		auth, err = newOAuthSASLClient(account, accessToken)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, checkAuthMethod(account.AuthMethod)
 	}
 
-	address := config.Server + ":" + config.Port
-	tlsConfig := &tls.Config{ServerName: config.Server}
+	address := account.Server + ":" + account.Port
+	tlsConfig := &tls.Config{ServerName: account.Server}
 	
-	c, err := client.DialTLS(address, tlsConfig)
+	conn, err := tls.Dial("tcp", address, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
+	
+	// Servers with the BINARY extension may answer with literal8
+	c, err := client.New(newLiteral8Conn(conn))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-	if err := c.Login(config.Email, password); err != nil {
+	if auth != nil {
+		err = c.Authenticate(auth)
+	} else {
+		err = c.Login(account.Email, password)
+	}
+	if err != nil {
 		c.Close()
 		return nil, fmt.Errorf("authentication error: %v", err)
 	}
 
-	fmt.Println("Successfully connected to Gmail")
+	fmt.Printf("Successfully connected to %s\n", account.providerName())
 	return c, nil
 }
\ No newline at end of file
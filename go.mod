@@ -2,9 +2,16 @@ module invoice-email-searcher
 
 go 1.21
 
-require github.com/emersion/go-imap v1.2.1
+require (
+	github.com/emersion/go-imap v1.2.1
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
+	golang.org/x/crypto v0.13.0
+	golang.org/x/term v0.12.0
+	golang.org/x/text v0.13.0
+)
 
 require (
-	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
-	golang.org/x/text v0.13.0 // indirect
+	github.com/emersion/go-message v0.15.0 // indirect
+	github.com/emersion/go-textwrapper v0.0.0-20200911093747-65d896831594 // indirect
+	golang.org/x/sys v0.12.0 // indirect
 )
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Name of the persistent download index, kept next to the period folders
+const indexFileName = "invoice_index.jsonl"
+
+// errAlreadyArchived is returned for attachments whose content is in the index
+var errAlreadyArchived = errors.New("already have")
+
+// indexRecord is one saved attachment, stored as a JSON line
+type indexRecord struct {
+	Hash      string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	Account   string    `json:"account"`
+	Folder    string    `json:"folder"`
+	Uid       uint32    `json:"uid"`
+	MessageID string    `json:"message_id,omitempty"`
+	Filename  string    `json:"original_filename"`
+	Path      string    `json:"path"`
+	From      string    `json:"from,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Time      time.Time `json:"downloaded_at"`
+	Reasons   []reason  `json:"reasons,omitempty"`
+}
+
+// downloadIndex knows every attachment archived by earlier runs and this one
+type downloadIndex struct {
+	// JSONL file, empty for an in-memory index
+	path   string
+	byHash map[string]*indexRecord
+	// Records added in this run
+	added      []*indexRecord
+	addedInRun map[string]bool
+	// Attachments skipped in this run because an earlier run archived their content
+	alreadyHave int
+}
+
+// Index of the current run, shared by all accounts
+var archive = newDownloadIndex("")
+
+func newDownloadIndex(path string) *downloadIndex {
+	return &downloadIndex{
+		path:       path,
+		byHash:     make(map[string]*indexRecord),
+		addedInRun: make(map[string]bool),
+	}
+}
+
+// indexFilePath is the configured index file, or the default next to the output folder
+func indexFilePath(config *Config, outputDir string) string {
+	if config.IndexFile != "" {
+		return config.IndexFile
+	}
+	return filepath.Join(filepath.Dir(outputDir), indexFileName)
+}
+
+// loadDownloadIndex reads the index file; a missing file is an empty index
+func loadDownloadIndex(path string) (*downloadIndex, error) {
+	idx := newDownloadIndex(path)
+	
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		
+		var rec indexRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			fmt.Printf("Index line %d skipped: %v\n", line, err)
+			continue
+		}
+		idx.byHash[rec.Hash] = &rec
+	}
+	
+	return idx, scanner.Err()
+}
+
+func (idx *downloadIndex) lookup(hash string) *indexRecord {
+	return idx.byHash[hash]
+}
+
+// fromEarlierRun reports whether a record was archived before this run
+func (idx *downloadIndex) fromEarlierRun(rec *indexRecord) bool {
+	return !idx.addedInRun[rec.Hash]
+}
+
+// add records a saved attachment and appends it to the index file right away,
+// so an interrupted run keeps what it already saved
+func (idx *downloadIndex) add(rec *indexRecord) error {
+	idx.byHash[rec.Hash] = rec
+	idx.added = append(idx.added, rec)
+	idx.addedInRun[rec.Hash] = true
+	
+	if idx.path == "" {
+		return nil
+	}
+	
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	
+	f, err := os.OpenFile(idx.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// relPath stores saved paths relative to the index, so the archive can be moved
+func (idx *downloadIndex) relPath(filePath string) string {
+	if idx.path == "" {
+		return filePath
+	}
+	rel, err := filepath.Rel(filepath.Dir(idx.path), filePath)
+	if err != nil {
+		return filePath
+	}
+	return filepath.ToSlash(rel)
+}
+
+// filePath resolves a saved path of the index
+func (idx *downloadIndex) filePath(rec *indexRecord) string {
+	path := filepath.FromSlash(rec.Path)
+	if idx.path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(idx.path), path)
+}
+
+// dirs lists the folders that hold indexed files
+func (idx *downloadIndex) dirs() []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, rec := range idx.byHash {
+		dir := filepath.Dir(idx.filePath(rec))
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// verify checks that every indexed file still exists with the recorded size
+// and hash, prints the ones that do not and returns how many failed
+func (idx *downloadIndex) verify() int {
+	records := make([]*indexRecord, 0, len(idx.byHash))
+	for _, rec := range idx.byHash {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Path < records[j].Path
+	})
+	
+	failed := 0
+	for _, rec := range records {
+		if err := verifyFile(idx.filePath(rec), rec); err != nil {
+			fmt.Printf("✗ %s: %v\n", rec.Path, err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// verifyFile compares a saved file with its index record
+func verifyFile(path string, rec *indexRecord) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("missing")
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return err
+	}
+	if size != rec.Size {
+		return fmt.Errorf("size %d, index has %d", size, rec.Size)
+	}
+	if hash := fmt.Sprintf("%x", hasher.Sum(nil)); hash != rec.Hash {
+		return fmt.Errorf("content changed, sha256 %s", hash)
+	}
+	return nil
+}
@@ -8,48 +8,170 @@ import (
 
 func main() {
 	// Parse command line flags
-	var month string
+	var periodOpts periodFlags
 	var outputDir string
-	flag.StringVar(&month, "month", "", "Month to search (YYYY-MM)")
+	var accountName string
+	var fullScan bool
+	var exhaustive bool
+	var prefilter bool
+	flag.StringVar(&periodOpts.month, "month", "", "Month to search (YYYY-MM)")
+	flag.StringVar(&periodOpts.from, "from", "", "First day to search (YYYY-MM-DD)")
+	flag.StringVar(&periodOpts.to, "to", "", "Last day to search (YYYY-MM-DD), default today")
+	flag.StringVar(&periodOpts.quarter, "quarter", "", "Quarter to search (YYYY-QN, e.g. 2025-Q3)")
+	flag.StringVar(&periodOpts.year, "year", "", "Calendar or fiscal year to search (YYYY)")
+	flag.StringVar(&periodOpts.since, "since", "", "Relative period ending today (e.g. 14d, 2w, 3m)")
 	flag.StringVar(&outputDir, "output", "", "Output directory for attachments")
+	flag.StringVar(&accountName, "account", allAccounts, "Account name or email to process, or \"all\"")
+	flag.BoolVar(&fullScan, "full", false, "Ignore saved sync state and rescan the whole period")
+	flag.BoolVar(&exhaustive, "exhaustive", false, "Fetch every message of the period without server-side prefiltering")
+	flag.BoolVar(&prefilter, "prefilter", false, "Prefilter on non-Gmail servers too (may miss invoices matched only by attachment name)")
+	flag.IntVar(&passphraseFD, "passphrase-fd", -1, "Read master passphrase from this file descriptor")
 	flag.Parse()
 
 	// Load configuration
 	config := loadConfig()
 
-	// Get month if not provided via flag
-	if month == "" {
-		month = getMonthInput()
+	accounts, err := config.selectAccounts(accountName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Built-in vendor registry with the user's additions
+	vendors, err = loadVendors(vendorFilePath(config))
+	if err != nil {
+		log.Fatalf("Vendor registry error: %v", err)
 	}
-	
-	if month == "" {
-		log.Fatal("Month cannot be empty")
+
+	switch flag.Arg(0) {
+	case "":
+	case "setup-oauth":
+		if len(accounts) != 1 {
+			log.Fatal("setup-oauth needs a single account, select it with -account")
+		}
+		if err := setupOAuth(config, accounts[0]); err != nil {
+			log.Fatalf("OAuth setup error: %v", err)
+		}
+		fmt.Printf("OAuth tokens saved to %s\n", configFile)
+		return
+	case "verify":
+		// Check saved files against the download index
+		indexPath := indexFilePath(config, outputDir)
+		index, err := loadDownloadIndex(indexPath)
+		if err != nil {
+			log.Fatalf("Index load error: %v", err)
+		}
+		if failed := index.verify(); failed > 0 {
+			log.Fatalf("%d of %d indexed files failed verification (%s)", failed, len(index.byHash), indexPath)
+		}
+		fmt.Printf("✓ All %d indexed files match %s\n", len(index.byHash), indexPath)
+		return
+	case "explain":
+		// Show why the attachments of a message were downloaded or skipped
+		if flag.Arg(1) == "" {
+			log.Fatal("explain needs a UID or Message-ID")
+		}
+		if err := explain(config, outputDir, flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command: %s", flag.Arg(0))
+	}
+
+	// Get month if no period provided via flags
+	if periodOpts == (periodFlags{}) {
+		periodOpts.month = getMonthInput()
+		if periodOpts.month == "" {
+			log.Fatal("Month cannot be empty")
+		}
+	}
+
+	loc, err := loadLocation(config.Timezone)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	period, err := parsePeriod(periodOpts, config.FiscalYearStart, loc)
+	if err != nil {
+		log.Fatalf("Period error: %v", err)
 	}
 
 	// Determine output directory
 	finalOutputDir := outputDir
 	if finalOutputDir == "" {
-		finalOutputDir = fmt.Sprintf("invoices_%s", month)
+		finalOutputDir = fmt.Sprintf("invoices_%s", period.label)
 	}
 
-	// Connect to Gmail
-	fmt.Printf("Connecting to Gmail (%s)...\n", config.Email)
-	client, err := connectToGmail(config)
+	// Persistent index of archived attachments, next to the period folders by default
+	indexPath := indexFilePath(config, finalOutputDir)
+	archive, err = loadDownloadIndex(indexPath)
 	if err != nil {
-		log.Fatalf("Connection error: %v", err)
+		log.Fatalf("Index load error: %v", err)
 	}
 
-	// Search and download attachments
-	fmt.Printf("Starting search and download process...\n")
-	err = searchAndDownloadAttachments(client, month, finalOutputDir, config.Email, config)
-	if err != nil {
-		log.Fatalf("Search error: %v", err)
+	// Decisions on every candidate attachment, for the explain command
+	report = newRunReport(finalOutputDir)
+
+	// Partial downloads of interrupted runs
+	if removed := removeStaleTempFiles(append(archive.dirs(), finalOutputDir)); removed > 0 {
+		fmt.Printf("Removed %d incomplete downloads of an earlier run\n", removed)
+	}
+
+	// Per-folder positions from earlier runs of the same period
+	opts := &searchOptions{
+		period:       period,
+		outputDir:    finalOutputDir,
+		state:        loadSyncState(finalOutputDir, period.label),
+		exhaustive:   exhaustive,
+		prefilter:    prefilter,
+		seenMessages: make(map[string]bool),
+	}
+	if fullScan {
+		opts.state = newSyncState(finalOutputDir, period.label)
+	}
+
+	// Process each account; all of them share the output directory and dedup index
+	failed := 0
+	for _, account := range accounts {
+		fmt.Printf("Connecting to %s (%s)...\n", account.providerName(), account.label())
+		client, err := connectToGmail(config, account)
+		if err != nil {
+			fmt.Printf("Connection error for %s: %v\n", account.label(), err)
+			failed++
+			continue
+		}
+
+		// Search and download attachments
+		fmt.Printf("Starting search and download process...\n")
+		err = searchAndDownloadAttachments(client, opts, account, config)
+		if err != nil {
+			fmt.Printf("Search error for %s: %v\n", account.label(), err)
+			failed++
+		}
+		
+		fmt.Printf("✓ Closing %s connection...\n", account.providerName())
+		client.Close()
+		fmt.Printf("✓ %s connection closed\n", account.providerName())
+	}
+
+	if err := writeManifest(finalOutputDir); err != nil {
+		fmt.Printf("Manifest save error: %v\n", err)
+	}
+
+	if summary := report.summary(); summary != "" {
+		fmt.Printf("Attachments: %s (%s)\n", summary, report.path)
+	}
+	if n := report.counts[outcomeReview]; n > 0 {
+		fmt.Printf("%d attachments need review, see %s\n", n, report.queuePath)
+	}
+
+	if archive.alreadyHave > 0 {
+		fmt.Printf("Already have %d attachments from earlier runs (%s)\n", archive.alreadyHave, indexPath)
+	}
+
+	if failed > 0 {
+		log.Fatalf("%d of %d accounts failed", failed, len(accounts))
 	}
-	
-	fmt.Printf("✓ Returned from searchAndDownloadAttachments function\n")
-	fmt.Printf("✓ Closing Gmail connection...\n")
-	client.Close()
-	fmt.Printf("✓ Gmail connection closed\n")
 
 	fmt.Printf("Search completed. Attachments saved to: %s\n", finalOutputDir)
 }
\ No newline at end of file
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+func init() {
+	// go-imap decodes RFC 2047 encoded-words in envelopes and MIME parameters,
+	// but only knows UTF-8 and ISO-8859-1 on its own
+	imap.CharsetReader = charsetReader
+}
+
+// charsetReader converts text in any charset known to golang.org/x/text to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %q", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// decodeWords decodes RFC 2047 encoded-words, keeping the text as is on error
+func decodeWords(s string) string {
+	if !strings.Contains(s, "=?") {
+		return s
+	}
+	decoded, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// paramValue returns a MIME parameter such as filename, joining RFC 2231
+// continuations (name*0, name*1*, ...) and decoding charset and
+// percent-encoding of extended values (name*=UTF-8''Facture%20n%C2%B0)
+func paramValue(params map[string]string, name string) string {
+	if value, ok := params[name+"*"]; ok {
+		parts := strings.SplitN(value, "'", 3)
+		if len(parts) == 3 {
+			return toUTF8(unescapeExtended(parts[2]), parts[0])
+		}
+	}
+	
+	// Collect numbered segments
+	type segment struct {
+		index    int
+		value    string
+		extended bool
+	}
+	var segments []segment
+	prefix := name + "*"
+	for key, value := range params {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		number := strings.TrimPrefix(key, prefix)
+		extended := strings.HasSuffix(number, "*")
+		index, err := strconv.Atoi(strings.TrimSuffix(number, "*"))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{index: index, value: value, extended: extended})
+	}
+	
+	if len(segments) == 0 {
+		return decodeWords(params[name])
+	}
+	
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].index < segments[j].index
+	})
+	
+	// Only the first segment carries charset'language', the bytes of all
+	// segments are converted together so multibyte characters may be split
+	charset := ""
+	var raw strings.Builder
+	for i, seg := range segments {
+		if seg.index != i {
+			break
+		}
+		if !seg.extended {
+			raw.WriteString(seg.value)
+			continue
+		}
+		value := seg.value
+		if i == 0 {
+			if parts := strings.SplitN(value, "'", 3); len(parts) == 3 {
+				charset, value = parts[0], parts[2]
+			}
+		}
+		raw.WriteString(unescapeExtended(value))
+	}
+	return decodeWords(toUTF8(raw.String(), charset))
+}
+
+// unescapeExtended undoes the percent-encoding of RFC 2231 values
+func unescapeExtended(s string) string {
+	unescaped, err := url.PathUnescape(s)
+	if err != nil {
+		return s
+	}
+	return unescaped
+}
+
+// toUTF8 converts text from the given charset, keeping it as is when unknown
+func toUTF8(s string, charset string) string {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "us-ascii":
+		return s
+	}
+	reader, err := charsetReader(charset, strings.NewReader(s))
+	if err != nil {
+		return s
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return s
+	}
+	return string(decoded)
+}
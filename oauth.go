@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// Values for Config.AuthMethod
+const (
+	authMethodPassword    = "password"
+	authMethodXOAuth2     = "xoauth2"
+	authMethodOAuthBearer = "oauthbearer"
+)
+
+// Google endpoints used when the config does not set its own
+const (
+	defaultOAuthAuthURL  = "https://accounts.google.com/o/oauth2/auth"
+	defaultOAuthTokenURL = "https://oauth2.googleapis.com/token"
+	defaultOAuthScope    = "https://mail.google.com/"
+)
+
+const oauthHTTPTimeout = 30 * time.Second
+
+// OAuthConfig holds the OAuth 2.0 client and the encrypted refresh token
+type OAuthConfig struct {
+	ClientID              string `json:"client_id"`
+	EncryptedClientSecret string `json:"encrypted_client_secret,omitempty"`
+	AuthURL               string `json:"auth_url,omitempty"`
+	TokenURL              string `json:"token_url,omitempty"`
+	Scope                 string `json:"scope,omitempty"`
+	EncryptedRefreshToken string `json:"encrypted_refresh_token,omitempty"`
+}
+
+type oauthToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// checkAuthMethod rejects auth_method values other than the known ones
+func checkAuthMethod(method string) error {
+	switch method {
+	case "", authMethodPassword, authMethodXOAuth2, authMethodOAuthBearer:
+		return nil
+	}
+	return fmt.Errorf("unknown auth_method %q (known: %s, %s, %s)", method, authMethodPassword, authMethodXOAuth2, authMethodOAuthBearer)
+}
+
+func (o *OAuthConfig) authURL() string {
+	if o.AuthURL != "" {
+		return o.AuthURL
+	}
+	return defaultOAuthAuthURL
+}
+
+func (o *OAuthConfig) tokenURL() string {
+	if o.TokenURL != "" {
+		return o.TokenURL
+	}
+	return defaultOAuthTokenURL
+}
+
+func (o *OAuthConfig) scope() string {
+	if o.Scope != "" {
+		return o.Scope
+	}
+	return defaultOAuthScope
+}
+
+// xoauth2Client implements Google's XOAUTH2 SASL mechanism
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return "XOAUTH2", ir, nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server sends a JSON error as challenge, an empty response ends the exchange
+	return []byte{}, nil
+}
+
+// newOAuthSASLClient returns the SASL client for the configured OAuth mechanism
+func newOAuthSASLClient(account *Account, accessToken string) (sasl.Client, error) {
+	switch account.AuthMethod {
+	case authMethodXOAuth2:
+		return &xoauth2Client{username: account.Email, token: accessToken}, nil
+	case authMethodOAuthBearer:
+		port := 0
+		fmt.Sscanf(account.Port, "%d", &port)
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: account.Email,
+			Token:    accessToken,
+			Host:     account.Server,
+			Port:     port,
+		}), nil
+	}
+	
+	return nil, fmt.Errorf("unknown auth method %q", account.AuthMethod)
+}
+
+// oauthAccessToken exchanges the stored refresh token for a fresh access token
+func oauthAccessToken(config *Config, account *Account) (string, error) {
+	if account.OAuth == nil || account.OAuth.EncryptedRefreshToken == "" {
+		return "", fmt.Errorf("no OAuth refresh token, run setup-oauth first")
+	}
+	
+	refreshToken, err := decryptSecret(config, account.OAuth.EncryptedRefreshToken)
+	if err != nil {
+		return "", fmt.Errorf("refresh token decryption error: %v", err)
+	}
+	
+	clientSecret := ""
+	if account.OAuth.EncryptedClientSecret != "" {
+		clientSecret, err = decryptSecret(config, account.OAuth.EncryptedClientSecret)
+		if err != nil {
+			return "", fmt.Errorf("client secret decryption error: %v", err)
+		}
+	}
+	
+	token, err := requestOAuthToken(account.OAuth.tokenURL(), url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {account.OAuth.ClientID},
+		"client_secret": {clientSecret},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return "", fmt.Errorf("token refresh error: %v", err)
+	}
+	
+	// Some providers rotate the refresh token on every use
+	if token.RefreshToken != "" && token.RefreshToken != refreshToken {
+		encrypted, err := encryptSecret(config, token.RefreshToken)
+		if err != nil {
+			return "", err
+		}
+		account.OAuth.EncryptedRefreshToken = encrypted
+		if err := saveConfig(config, configFile); err != nil {
+			fmt.Printf("Configuration save error: %v\n", err)
+		}
+	}
+	
+	return token.AccessToken, nil
+}
+
+func requestOAuthToken(tokenURL string, form url.Values) (*oauthToken, error) {
+	httpClient := &http.Client{Timeout: oauthHTTPTimeout}
+	resp, err := httpClient.PostForm(tokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	
+	var token oauthToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("token response parsing error (HTTP %d): %v", resp.StatusCode, err)
+	}
+	
+	if token.Error != "" {
+		return nil, fmt.Errorf("%s: %s", token.Error, token.Description)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned HTTP %d", resp.StatusCode)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token response has no access token")
+	}
+	
+	return &token, nil
+}
+
+// setupOAuth runs the authorization code flow with a loopback redirect and
+// stores the encrypted refresh token in the configuration
+func setupOAuth(config *Config, account *Account) error {
+	if account.OAuth == nil {
+		account.OAuth = &OAuthConfig{}
+	}
+	
+	fmt.Printf("OAuth client ID [%s]: ", account.OAuth.ClientID)
+	if clientID := strings.TrimSpace(readLine()); clientID != "" {
+		account.OAuth.ClientID = clientID
+	}
+	if account.OAuth.ClientID == "" {
+		return fmt.Errorf("client ID cannot be empty")
+	}
+	
+	fmt.Print("OAuth client secret (empty to keep current): ")
+	clientSecret, err := readSecret()
+	if err != nil {
+		return err
+	}
+	clientSecret = strings.TrimSpace(clientSecret)
+	if clientSecret != "" {
+		encrypted, err := encryptSecret(config, clientSecret)
+		if err != nil {
+			return err
+		}
+		account.OAuth.EncryptedClientSecret = encrypted
+	} else if account.OAuth.EncryptedClientSecret != "" {
+		clientSecret, err = decryptSecret(config, account.OAuth.EncryptedClientSecret)
+		if err != nil {
+			return fmt.Errorf("client secret decryption error: %v", err)
+		}
+	}
+	
+	// Loopback redirect: the provider sends the browser back to us with the code
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	redirectURL := fmt.Sprintf("http://%s/", listener.Addr().String())
+	
+	stateBytes := make([]byte, 16)
+	if _, err := rand.Read(stateBytes); err != nil {
+		return err
+	}
+	state := hex.EncodeToString(stateBytes)
+	
+	authParams := url.Values{
+		"client_id":     {account.OAuth.ClientID},
+		"redirect_uri":  {redirectURL},
+		"response_type": {"code"},
+		"scope":         {account.OAuth.scope()},
+		"access_type":   {"offline"},
+		"prompt":        {"consent"},
+		"login_hint":    {account.Email},
+		"state":         {state},
+	}
+	fmt.Printf("Open this URL in your browser and grant access:\n\n%s?%s\n\n", account.OAuth.authURL(), authParams.Encode())
+	
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("state") != state {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		}
+		if e := query.Get("error"); e != "" {
+			fmt.Fprintf(w, "Authorization failed: %s\n", e)
+			// Only the first callback counts, later ones must not block the handler
+			select {
+			case errs <- fmt.Errorf("authorization failed: %s", e):
+			default:
+			}
+			return
+		}
+		fmt.Fprintln(w, "Authorization complete, you can close this window.")
+		select {
+		case codes <- query.Get("code"):
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+	
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-errs:
+		return err
+	case <-time.After(5 * time.Minute):
+		return fmt.Errorf("timed out waiting for authorization")
+	}
+	
+	token, err := requestOAuthToken(account.OAuth.tokenURL(), url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {account.OAuth.ClientID},
+		"client_secret": {clientSecret},
+	})
+	if err != nil {
+		return fmt.Errorf("code exchange error: %v", err)
+	}
+	if token.RefreshToken == "" {
+		return fmt.Errorf("token response has no refresh token")
+	}
+	
+	encrypted, err := encryptSecret(config, token.RefreshToken)
+	if err != nil {
+		return err
+	}
+	account.OAuth.EncryptedRefreshToken = encrypted
+	
+	if account.AuthMethod == "" || account.AuthMethod == authMethodPassword {
+		account.AuthMethod = authMethodXOAuth2
+	}
+	
+	return saveConfig(config, configFile)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// oauthTestConfig returns an account with an encrypted refresh token whose
+// token endpoint is the given URL, working in a temporary directory so a
+// rotated token is saved there
+func oauthTestConfig(t *testing.T, tokenURL string) (*Config, *Account) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	
+	config := &Config{KeySalt: "test", KeyVersion: currentKeyVersion, key: make([]byte, keySize)}
+	config.Email = "user@example.com"
+	config.AuthMethod = authMethodXOAuth2
+	config.OAuth = &OAuthConfig{ClientID: "client", TokenURL: tokenURL}
+	
+	encrypted, err := encryptSecret(config, "refresh-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.OAuth.EncryptedRefreshToken = encrypted
+	return config, &config.Account
+}
+
+func TestOAuthAccessToken(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		response    string
+		wantToken   string
+		wantErr     string
+		wantRefresh string
+	}{
+		{
+			name:        "refresh",
+			status:      http.StatusOK,
+			response:    `{"access_token":"access-1","expires_in":3600}`,
+			wantToken:   "access-1",
+			wantRefresh: "refresh-1",
+		},
+		{
+			name:        "error response",
+			status:      http.StatusBadRequest,
+			response:    `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`,
+			wantErr:     "invalid_grant: Token has been expired or revoked.",
+			wantRefresh: "refresh-1",
+		},
+		{
+			name:        "rotated refresh token",
+			status:      http.StatusOK,
+			response:    `{"access_token":"access-2","refresh_token":"refresh-2","expires_in":3600}`,
+			wantToken:   "access-2",
+			wantRefresh: "refresh-2",
+		},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("form parsing error: %v", err)
+				}
+				if got := r.PostForm.Get("grant_type"); got != "refresh_token" {
+					t.Errorf("grant_type = %q, want refresh_token", got)
+				}
+				if got := r.PostForm.Get("refresh_token"); got != "refresh-1" {
+					t.Errorf("refresh_token = %q, want refresh-1", got)
+				}
+				if got := r.PostForm.Get("client_id"); got != "client" {
+					t.Errorf("client_id = %q, want client", got)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+			
+			config, account := oauthTestConfig(t, server.URL)
+			token, err := oauthAccessToken(config, account)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if token != tt.wantToken {
+				t.Errorf("access token = %q, want %q", token, tt.wantToken)
+			}
+			
+			refresh, err := decryptSecret(config, account.OAuth.EncryptedRefreshToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if refresh != tt.wantRefresh {
+				t.Errorf("refresh token = %q, want %q", refresh, tt.wantRefresh)
+			}
+			
+			// A rotated token must also reach the configuration file
+			_, statErr := os.Stat(configFile)
+			if saved := statErr == nil; saved != (tt.wantRefresh != "refresh-1") {
+				t.Errorf("config saved = %v, want %v", saved, !saved)
+			}
+		})
+	}
+}
+
+func TestCheckAuthMethod(t *testing.T) {
+	for _, method := range []string{"", authMethodPassword, authMethodXOAuth2, authMethodOAuthBearer} {
+		if err := checkAuthMethod(method); err != nil {
+			t.Errorf("checkAuthMethod(%q): %v", method, err)
+		}
+	}
+	for _, method := range []string{"oauth", "xoauth", "XOAUTH2"} {
+		if err := checkAuthMethod(method); err == nil {
+			t.Errorf("checkAuthMethod(%q) accepted a typo", method)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchPeriod is the date range to search, start inclusive, end exclusive
+type searchPeriod struct {
+	// Short name used for the default output directory and sync state
+	label string
+	start time.Time
+	end   time.Time
+}
+
+// periodFlags are the command line options that select a period
+type periodFlags struct {
+	month   string
+	from    string
+	to      string
+	quarter string
+	year    string
+	since   string
+}
+
+// contains reports whether a message date falls inside the period
+func (p searchPeriod) contains(date time.Time) bool {
+	return !date.Before(p.start) && date.Before(p.end)
+}
+
+// loadLocation resolves the configured timezone, the local one when unset
+func loadLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+	}
+	return loc, nil
+}
+
+// parsePeriod builds the period from exactly one of the period options,
+// with day boundaries in the given timezone
+func parsePeriod(flags periodFlags, fiscalYearStart int, loc *time.Location) (searchPeriod, error) {
+	set := 0
+	for _, value := range []string{flags.month, flags.quarter, flags.year, flags.since, flags.from + flags.to} {
+		if value != "" {
+			set++
+		}
+	}
+	if set == 0 {
+		return searchPeriod{}, fmt.Errorf("no period given")
+	}
+	if set > 1 {
+		return searchPeriod{}, fmt.Errorf("use only one of -month, -from/-to, -quarter, -year, -since")
+	}
+	
+	switch {
+	case flags.month != "":
+		return parseMonth(flags.month, loc)
+	case flags.quarter != "":
+		return parseQuarter(flags.quarter, loc)
+	case flags.year != "":
+		return parseYear(flags.year, fiscalYearStart, loc)
+	case flags.since != "":
+		return parseSince(flags.since, time.Now().In(loc))
+	}
+	return parseRange(flags.from, flags.to, time.Now().In(loc))
+}
+
+// parseMonth parses YYYY-MM
+func parseMonth(month string, loc *time.Location) (searchPeriod, error) {
+	date, err := time.ParseInLocation("2006-01", month, loc)
+	if err != nil {
+		return searchPeriod{}, fmt.Errorf("invalid month format (need YYYY-MM): %s", month)
+	}
+	
+	return searchPeriod{
+		label: month,
+		start: date,
+		end:   date.AddDate(0, 1, 0),
+	}, nil
+}
+
+// parseQuarter parses YYYY-QN (calendar quarters)
+func parseQuarter(quarter string, loc *time.Location) (searchPeriod, error) {
+	parts := strings.SplitN(strings.ToUpper(quarter), "-Q", 2)
+	if len(parts) != 2 {
+		return searchPeriod{}, fmt.Errorf("invalid quarter format (need YYYY-QN): %s", quarter)
+	}
+	
+	year, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts[0]) != 4 {
+		return searchPeriod{}, fmt.Errorf("invalid quarter year: %s", quarter)
+	}
+	number, err := strconv.Atoi(parts[1])
+	if err != nil || number < 1 || number > 4 {
+		return searchPeriod{}, fmt.Errorf("invalid quarter number (need 1-4): %s", quarter)
+	}
+	
+	start := time.Date(year, time.Month((number-1)*3+1), 1, 0, 0, 0, 0, loc)
+	return searchPeriod{
+		label: fmt.Sprintf("%d-Q%d", year, number),
+		start: start,
+		end:   start.AddDate(0, 3, 0),
+	}, nil
+}
+
+// parseYear parses YYYY. With a fiscal year start other than January, the
+// fiscal year is named after the calendar year it starts in.
+func parseYear(yearText string, fiscalYearStart int, loc *time.Location) (searchPeriod, error) {
+	year, err := strconv.Atoi(yearText)
+	if err != nil || len(yearText) != 4 {
+		return searchPeriod{}, fmt.Errorf("invalid year format (need YYYY): %s", yearText)
+	}
+	
+	if fiscalYearStart == 0 {
+		fiscalYearStart = 1
+	}
+	if fiscalYearStart < 1 || fiscalYearStart > 12 {
+		return searchPeriod{}, fmt.Errorf("invalid fiscal_year_start (need 1-12): %d", fiscalYearStart)
+	}
+	
+	label := yearText
+	if fiscalYearStart != 1 {
+		label = "FY" + yearText
+	}
+	
+	start := time.Date(year, time.Month(fiscalYearStart), 1, 0, 0, 0, 0, loc)
+	return searchPeriod{
+		label: label,
+		start: start,
+		end:   start.AddDate(1, 0, 0),
+	}, nil
+}
+
+// parseSince parses a relative period ending today (in now's timezone): 14d, 2w or 3m
+func parseSince(since string, now time.Time) (searchPeriod, error) {
+	if len(since) < 2 {
+		return searchPeriod{}, fmt.Errorf("invalid relative period (need e.g. 14d, 2w, 3m): %s", since)
+	}
+	
+	count, err := strconv.Atoi(since[:len(since)-1])
+	if err != nil || count <= 0 {
+		return searchPeriod{}, fmt.Errorf("invalid relative period (need e.g. 14d, 2w, 3m): %s", since)
+	}
+	
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	end := today.AddDate(0, 0, 1)
+	
+	var start time.Time
+	switch since[len(since)-1] {
+	case 'd':
+		start = end.AddDate(0, 0, -count)
+	case 'w':
+		start = end.AddDate(0, 0, -7*count)
+	case 'm':
+		start = end.AddDate(0, -count, 0)
+	default:
+		return searchPeriod{}, fmt.Errorf("invalid relative period unit (need d, w or m): %s", since)
+	}
+	
+	return searchPeriod{
+		label: "last_" + since,
+		start: start,
+		end:   end,
+	}, nil
+}
+
+// parseRange parses -from/-to dates (YYYY-MM-DD, both inclusive); -to defaults to today
+func parseRange(from, to string, now time.Time) (searchPeriod, error) {
+	if from == "" {
+		return searchPeriod{}, fmt.Errorf("-to needs -from")
+	}
+	
+	start, err := time.ParseInLocation("2006-01-02", from, now.Location())
+	if err != nil {
+		return searchPeriod{}, fmt.Errorf("invalid -from date (need YYYY-MM-DD): %s", from)
+	}
+	
+	last := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if to != "" {
+		last, err = time.ParseInLocation("2006-01-02", to, now.Location())
+		if err != nil {
+			return searchPeriod{}, fmt.Errorf("invalid -to date (need YYYY-MM-DD): %s", to)
+		}
+	}
+	
+	if last.Before(start) {
+		return searchPeriod{}, fmt.Errorf("-to %s is before -from %s", last.Format("2006-01-02"), from)
+	}
+	
+	return searchPeriod{
+		label: start.Format("2006-01-02") + "_" + last.Format("2006-01-02"),
+		start: start,
+		end:   last.AddDate(0, 0, 1),
+	}, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Server-side prefiltering narrows the date search to messages that can
+// possibly be classified as invoices, so far fewer messages are fetched.
+
+// Words of attachmentRegex, searched in attachment names with Gmail's
+// filename: operator; purely numeric names cannot be searched
+var prefilterFilenameWords = []string{
+	"inv", "invs", "invoice", "invoices", "bill", "bills", "billing",
+	"receipt", "rec", "rct", "cheque", "check", "pay", "payment",
+	"transaction", "statement", "factura", "facture", "rechnung", "nota",
+	"attachment",
+}
+
+// buildSearchQuery returns the search for the period, narrowed on the server
+// unless the run is exhaustive
+func buildSearchQuery(c *client.Client, opts *searchOptions, account *Account, config *Config) searchQuery {
+	query := searchQuery{criteria: createSearchCriteria(opts.period)}
+	if opts.exhaustive {
+		return query
+	}
+	
+	words, filenames, senders, recipients := prefilterTerms(account, config)
+	
+	if hasGmailExtensions(c, account) {
+		query.gmailRaw = gmailRawQuery(words, filenames, senders, recipients)
+		query.filter = query.gmailRaw
+		return query
+	}
+	
+	// Elsewhere attachment names only match through words, so invoices with
+	// names like 20250901.pdf would be missed: narrowing is opt-in
+	if !opts.prefilter {
+		return query
+	}
+	
+	// TEXT also searches the body and the MIME part headers holding filenames
+	terms := []*imap.SearchCriteria{}
+	filterTerms := []string{}
+	for _, word := range append(append([]string{}, words...), filenames...) {
+		terms = append(terms, &imap.SearchCriteria{Text: []string{word}})
+		filterTerms = append(filterTerms, "TEXT "+word)
+	}
+	for _, sender := range senders {
+		terms = append(terms, &imap.SearchCriteria{Header: map[string][]string{"From": {sender}}})
+		filterTerms = append(filterTerms, "FROM "+sender)
+	}
+	for _, recipient := range recipients {
+		terms = append(terms, &imap.SearchCriteria{Header: map[string][]string{"To": {recipient}}})
+		filterTerms = append(filterTerms, "TO "+recipient)
+	}
+	if len(terms) == 0 {
+		return query
+	}
+	query.filter = strings.Join(filterTerms, " OR ")
+	
+	root := orCriteria(terms)
+	if len(root.Or) > 0 {
+		query.criteria.Or = root.Or
+	} else {
+		query.criteria.Header = root.Header
+	}
+	return query
+}
+
+// prefilterTerms collects keywords and vendor phrases, attachment name
+// words, sender domains and group recipients that the local classification
+// reacts to
+func prefilterTerms(account *Account, config *Config) (words, filenames, senders, recipients []string) {
+	seen := make(map[string]bool)
+	for _, word := range append(append(append(append([]string{}, config.Keywords...), invoiceSubjectPhrases...), invoiceSubjectPatterns()...), vendorBodyPatterns()...) {
+		word = strings.ToLower(strings.TrimSpace(word))
+		if word != "" && !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	
+	seenFilename := make(map[string]bool)
+	for _, word := range append(append(append([]string{}, prefilterFilenameWords...), config.Keywords...), vendorFilenamePatterns()...) {
+		word = strings.ToLower(strings.TrimSpace(word))
+		if word != "" && !seenFilename[word] {
+			seenFilename[word] = true
+			filenames = append(filenames, word)
+		}
+	}
+	
+	senders = append(senders, vendorDomains()...)
+	sort.Strings(senders)
+	
+	if atIndex := strings.LastIndex(account.Email, "@"); atIndex != -1 {
+		domain := account.Email[atIndex+1:]
+		for _, prefix := range groupPrefixes {
+			recipients = append(recipients, prefix+domain)
+		}
+	}
+	
+	return words, filenames, senders, recipients
+}
+
+// gmailRawQuery builds an X-GM-RAW query such as
+// has:attachment {invoice receipt filename:rechnung from:stripe.com to:billing@example.com}
+func gmailRawQuery(words, filenames, senders, recipients []string) string {
+	quote := func(word string) string {
+		if strings.ContainsAny(word, " \t") {
+			return `"` + strings.ReplaceAll(word, `"`, "") + `"`
+		}
+		return word
+	}
+	
+	terms := []string{}
+	for _, word := range words {
+		terms = append(terms, quote(word))
+	}
+	for _, filename := range filenames {
+		terms = append(terms, "filename:"+quote(filename))
+	}
+	for _, sender := range senders {
+		terms = append(terms, "from:"+sender)
+	}
+	for _, recipient := range recipients {
+		terms = append(terms, "to:"+recipient)
+	}
+	
+	// Braces are Gmail's OR group
+	return "has:attachment {" + strings.Join(terms, " ") + "}"
+}
+
+// orCriteria combines criteria into a balanced OR tree, keeping it shallow
+// for servers that limit search nesting
+func orCriteria(terms []*imap.SearchCriteria) *imap.SearchCriteria {
+	if len(terms) == 1 {
+		return terms[0]
+	}
+	
+	mid := len(terms) / 2
+	return &imap.SearchCriteria{
+		Or: [][2]*imap.SearchCriteria{{orCriteria(terms[:mid]), orCriteria(terms[mid:])}},
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Values for Account.Provider
+const (
+	providerGmail    = "gmail"
+	providerOutlook  = "outlook"
+	providerFastmail = "fastmail"
+	providerGeneric  = "generic"
+)
+
+// providerPreset holds connection defaults and folder policy for a mail provider
+type providerPreset struct {
+	// Name shown in progress messages, the server for generic accounts
+	name   string
+	server string
+	port   string
+	// SPECIAL-USE folder kinds that are never searched
+	skipFolders []string
+	// Gmail IMAP extensions (X-GM-RAW, X-GM-MSGID) are available
+	gmailExtensions bool
+}
+
+var providerPresets = map[string]providerPreset{
+	providerGmail: {
+		name:   "Gmail",
+		server: "imap.gmail.com",
+		port:   "993",
+		// Starred and Important only repeat messages that are already in All Mail
+		skipFolders:     []string{imap.DraftsAttr, imap.SentAttr, imap.JunkAttr, imap.TrashAttr, imap.FlaggedAttr, imap.ImportantAttr},
+		gmailExtensions: true,
+	},
+	providerOutlook: {
+		name:        "Outlook",
+		server:      "outlook.office365.com",
+		port:        "993",
+		skipFolders: []string{imap.DraftsAttr, imap.SentAttr, imap.JunkAttr, imap.TrashAttr},
+	},
+	providerFastmail: {
+		name:        "Fastmail",
+		server:      "imap.fastmail.com",
+		port:        "993",
+		skipFolders: []string{imap.DraftsAttr, imap.SentAttr, imap.JunkAttr, imap.TrashAttr},
+	},
+	providerGeneric: {
+		port:        "993",
+		skipFolders: []string{imap.DraftsAttr, imap.SentAttr, imap.JunkAttr, imap.TrashAttr, imap.FlaggedAttr},
+	},
+}
+
+// Folder names used to classify folders on servers without SPECIAL-USE (RFC 6154)
+var specialFolderNames = map[string]string{
+	"all mail":         imap.AllAttr,
+	"alle nachrichten": imap.AllAttr,
+	"archive":          imap.ArchiveAttr,
+	"drafts":           imap.DraftsAttr,
+	"entwürfe":         imap.DraftsAttr,
+	"sent":             imap.SentAttr,
+	"sent items":       imap.SentAttr,
+	"sent mail":        imap.SentAttr,
+	"sent messages":    imap.SentAttr,
+	"gesendet":         imap.SentAttr,
+	"junk":             imap.JunkAttr,
+	"junk email":       imap.JunkAttr,
+	"junk e-mail":      imap.JunkAttr,
+	"spam":             imap.JunkAttr,
+	"trash":            imap.TrashAttr,
+	"bin":              imap.TrashAttr,
+	"deleted items":    imap.TrashAttr,
+	"deleted messages": imap.TrashAttr,
+	"papierkorb":       imap.TrashAttr,
+	"starred":          imap.FlaggedAttr,
+	"important":        imap.ImportantAttr,
+}
+
+// provider returns the account's provider, guessed from the server when not set
+func (a *Account) provider() string {
+	if a.Provider != "" {
+		return strings.ToLower(a.Provider)
+	}
+	
+	server := strings.ToLower(a.Server)
+	switch {
+	case server == "" || strings.HasSuffix(server, "gmail.com") || strings.HasSuffix(server, "googlemail.com"):
+		return providerGmail
+	case strings.HasSuffix(server, "office365.com") || strings.HasSuffix(server, "outlook.com"):
+		return providerOutlook
+	case strings.HasSuffix(server, "fastmail.com"):
+		return providerFastmail
+	}
+	return providerGeneric
+}
+
+func (a *Account) preset() providerPreset {
+	if preset, exists := providerPresets[a.provider()]; exists {
+		return preset
+	}
+	return providerPresets[providerGeneric]
+}
+
+// providerName names the account's provider in progress messages
+func (a *Account) providerName() string {
+	if name := a.preset().name; name != "" {
+		return name
+	}
+	return a.Server
+}
+
+// hasGmailExtensions reports whether X-GM-RAW and X-GM-MSGID can be used
+func hasGmailExtensions(c *client.Client, account *Account) bool {
+	if !account.preset().gmailExtensions {
+		return false
+	}
+	ok, err := c.Support("X-GM-EXT-1")
+	return err == nil && ok
+}
+
+// applyProviderPresets fills empty server and port fields from the provider preset
+func applyProviderPresets(config *Config) {
+	for _, account := range config.accounts() {
+		preset := account.preset()
+		if account.Server == "" {
+			account.Server = preset.server
+		}
+		if account.Port == "" {
+			account.Port = preset.port
+		}
+	}
+}
+
+// folderKind returns the SPECIAL-USE attribute of a folder, falling back to
+// well-known folder names, or "" for regular folders
+func folderKind(m *imap.MailboxInfo) string {
+	for _, attr := range m.Attributes {
+		switch attr {
+		case imap.AllAttr, imap.ArchiveAttr, imap.DraftsAttr, imap.FlaggedAttr,
+			imap.JunkAttr, imap.SentAttr, imap.TrashAttr, imap.ImportantAttr:
+			return attr
+		}
+	}
+	
+	name := m.Name
+	if m.Delimiter != "" {
+		if idx := strings.LastIndex(name, m.Delimiter); idx != -1 {
+			name = name[idx+len(m.Delimiter):]
+		}
+	}
+	return specialFolderNames[strings.ToLower(name)]
+}
+
+// isSelectable reports whether a folder can be opened
+func isSelectable(m *imap.MailboxInfo) bool {
+	for _, attr := range m.Attributes {
+		if strings.EqualFold(attr, imap.NoSelectAttr) || strings.EqualFold(attr, "\\NonExistent") {
+			return false
+		}
+	}
+	return true
+}
+
+// searchFolders picks the folders to search besides INBOX according to the folder policy
+func searchFolders(mailboxes []*imap.MailboxInfo, preset providerPreset) []string {
+	folders := []string{}
+	for _, m := range mailboxes {
+		// INBOX is processed separately
+		if strings.EqualFold(m.Name, "INBOX") || !isSelectable(m) {
+			continue
+		}
+		
+		kind := folderKind(m)
+		skip := false
+		for _, skipKind := range preset.skipFolders {
+			if kind == skipKind {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			folders = append(folders, m.Name)
+		}
+	}
+	return folders
+}
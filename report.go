@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the run report, one per output folder, appended by every run
+const reportFileName = "run_report.jsonl"
+
+// Name of the review queue in the output folder, entries of the maybe band
+const reviewQueueFileName = "review_queue.jsonl"
+
+// Outcomes of a candidate attachment
+const (
+	outcomeDownloaded  = "downloaded"
+	outcomeSkipped     = "skipped"
+	outcomeReview      = "review"
+	outcomeAlreadyHave = "already_have"
+	outcomeFailed      = "failed"
+)
+
+var reportOutcomes = []string{outcomeDownloaded, outcomeReview, outcomeSkipped, outcomeAlreadyHave, outcomeFailed}
+
+// reportEntry is the decision on one candidate attachment, stored as a JSON line
+type reportEntry struct {
+	Time      time.Time `json:"time"`
+	Account   string    `json:"account"`
+	Folder    string    `json:"folder"`
+	Uid       uint32    `json:"uid"`
+	MessageID string    `json:"message_id,omitempty"`
+	From      string    `json:"from,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Filename  string    `json:"filename"`
+	Outcome   string    `json:"outcome"`
+	Score     float64   `json:"score"`
+	Path      string    `json:"path,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Reasons   []reason  `json:"reasons"`
+}
+
+// runReport collects the decisions of the current run
+type runReport struct {
+	// JSONL files, empty for an in-memory report
+	path      string
+	queuePath string
+	counts    map[string]int
+}
+
+// Report of the current run, shared by all accounts
+var report = newRunReport("")
+
+// newRunReport writes the report and the review queue to the output folder,
+// or keeps only the counts when the folder is ""
+func newRunReport(outputDir string) *runReport {
+	r := &runReport{counts: make(map[string]int)}
+	if outputDir != "" {
+		r.path = filepath.Join(outputDir, reportFileName)
+		r.queuePath = filepath.Join(outputDir, reviewQueueFileName)
+	}
+	return r
+}
+
+// record appends the decision on an attachment to the report file right away,
+// like the index, so interrupted runs can be explained too; attachments for
+// review also go to the review queue
+func (r *runReport) record(info messageInfo, attachment attachmentInfo, outcome, path string, err error, reasons []reason) {
+	r.counts[outcome]++
+	if r.path == "" {
+		return
+	}
+	
+	entry := reportEntry{
+		Time:      time.Now(),
+		Account:   info.account,
+		Folder:    info.folder,
+		Uid:       info.uid,
+		MessageID: info.messageID,
+		From:      info.from,
+		Subject:   info.subject,
+		Filename:  attachment.filename,
+		Outcome:   outcome,
+		Score:     score(reasons),
+		Path:      path,
+		Reasons:   reasons,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	
+	if err := appendJSONLine(r.path, entry); err != nil {
+		fmt.Printf("Report save error: %v\n", err)
+	}
+	if outcome == outcomeReview {
+		if err := appendJSONLine(r.queuePath, entry); err != nil {
+			fmt.Printf("Review queue save error: %v\n", err)
+		}
+	}
+}
+
+// appendJSONLine adds a value to a JSONL file, creating its folder if needed
+func appendJSONLine(path string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// summary lists the counts of the run by outcome, "" when nothing was recorded
+func (r *runReport) summary() string {
+	var parts []string
+	for _, outcome := range reportOutcomes {
+		if n := r.counts[outcome]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, strings.ReplaceAll(outcome, "_", " ")))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// loadReportEntries reads the entries of a report file; broken lines are skipped
+func loadReportEntries(path string) ([]reportEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	
+	var entries []reportEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry reportEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// reportFiles are the run reports of the given output folder, or of every
+// period folder next to the index when no folder is given
+func reportFiles(config *Config, outputDir string) ([]string, error) {
+	if outputDir != "" {
+		return []string{filepath.Join(outputDir, reportFileName)}, nil
+	}
+	base := filepath.Dir(indexFilePath(config, "invoices"))
+	return filepath.Glob(filepath.Join(base, "invoices_*", reportFileName))
+}
+
+// matchesMessage reports whether a UID or Message-ID names the message of an entry
+func matchesMessage(query string, uid uint32, messageID string) bool {
+	if n, err := strconv.ParseUint(query, 10, 32); err == nil {
+		return uint32(n) == uid
+	}
+	trim := func(id string) string {
+		return strings.Trim(strings.TrimSpace(id), "<>")
+	}
+	return messageID != "" && trim(query) == trim(messageID)
+}
+
+// explain prints the decisions of every run on the attachments of a message,
+// found by UID or Message-ID in the run reports and the download index
+func explain(config *Config, outputDir, query string) error {
+	files, err := reportFiles(config, outputDir)
+	if err != nil {
+		return err
+	}
+	
+	var entries []reportEntry
+	for _, file := range files {
+		fileEntries, err := loadReportEntries(file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Printf("Report read error: %v\n", err)
+			}
+			continue
+		}
+		for _, entry := range fileEntries {
+			if matchesMessage(query, entry.Uid, entry.MessageID) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	
+	lastMessage := ""
+	for _, entry := range entries {
+		message := fmt.Sprintf("%s %s UID %d", entry.Account, entry.Folder, entry.Uid)
+		if message != lastMessage {
+			fmt.Printf("%s: %q from %s %s\n", message, entry.Subject, entry.From, entry.MessageID)
+			lastMessage = message
+		}
+		fmt.Printf("  %s %s: %s, score %.2f", entry.Time.Format("2006-01-02 15:04"), entry.Filename, entry.Outcome, entry.Score)
+		if entry.Path != "" {
+			fmt.Printf(" (%s)", entry.Path)
+		}
+		if entry.Error != "" {
+			fmt.Printf(": %s", entry.Error)
+		}
+		fmt.Printf("\n")
+		for _, r := range entry.Reasons {
+			fmt.Printf("    %s\n", r)
+		}
+	}
+	
+	// Files archived by runs whose report is elsewhere are still in the index
+	index, err := loadDownloadIndex(indexFilePath(config, outputDir))
+	if err != nil {
+		return err
+	}
+	var records []*indexRecord
+	for _, rec := range index.byHash {
+		if matchesMessage(query, rec.Uid, rec.MessageID) {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Path < records[j].Path
+	})
+	for _, rec := range records {
+		fmt.Printf("Index: %s from %s %s UID %d, %s\n", rec.Path, rec.Account, rec.Folder, rec.Uid, rec.Time.Format("2006-01-02 15:04"))
+		for _, r := range rec.Reasons {
+			fmt.Printf("    %s\n", r)
+		}
+	}
+	
+	if len(entries) == 0 && len(records) == 0 {
+		return fmt.Errorf("no decisions recorded for %s", query)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Longest saved filename in bytes, leaving room for the service prefix and
+// counter within the usual 255 byte limit
+const maxFilenameLength = 200
+
+// Names Windows reserves for devices, with or without an extension
+var reservedFilenames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFilename turns a sender-supplied attachment name into a plain file
+// name that stays inside the output directory on any OS
+func sanitizeFilename(name string) string {
+	name = norm.NFC.String(name)
+	
+	// Drop directory components of both path styles
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i != -1 {
+		name = name[i+1:]
+	}
+	
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError:
+			return '_'
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			// Control and invisible format characters, e.g. right-to-left override
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	
+	// Leading dots hide files and ".." climbs up; Windows drops trailing dots and spaces
+	name = strings.Trim(name, ". ")
+	
+	base := name
+	if i := strings.Index(base, "."); i != -1 {
+		base = base[:i]
+	}
+	if reservedFilenames[strings.ToUpper(strings.TrimSpace(base))] {
+		name = "_" + name
+	}
+	
+	name = truncateFilename(name, maxFilenameLength)
+	if name == "" {
+		return "attachment"
+	}
+	return name
+}
+
+// truncateFilename shortens a name to max bytes, keeping a short extension
+// and whole UTF-8 characters
+func truncateFilename(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	
+	limit := max - len(ext)
+	for limit > 0 && !utf8.RuneStart(base[limit]) {
+		limit--
+	}
+	return strings.TrimRight(base[:limit], ". ") + ext
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	longName := strings.Repeat("Rechnung-ÄÖÜ-€", 30) + ".pdf"
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"invoice.pdf", "invoice.pdf"},
+		{"../../.bashrc", "bashrc"},
+		{`..\..\x`, "x"},
+		{`C:\Users\me\invoice.pdf`, "invoice.pdf"},
+		{"in\x00vo\nice\x7f.pdf", "invoice.pdf"},
+		{"invoice\u202efdp.exe", "invoicefdp.exe"},
+		{`a<b>c:d"e|f?g*.pdf`, "a_b_c_d_e_f_g_.pdf"},
+		{"CON.pdf", "_CON.pdf"},
+		{"lpt1", "_lpt1"},
+		{"invoice.pdf. . ", "invoice.pdf"},
+		{"", "attachment"},
+		{"../..", "attachment"},
+		{" . \u200b", "attachment"},
+		{longName, truncateFilename(longName, maxFilenameLength)},
+	}
+	
+	for _, tt := range tests {
+		got := sanitizeFilename(tt.name)
+		if got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	
+	got := sanitizeFilename(longName)
+	if len(got) > maxFilenameLength || !utf8.ValidString(got) || !strings.HasSuffix(got, ".pdf") {
+		t.Errorf("sanitizeFilename(long name) = %q (%d bytes), want valid UTF-8 of at most %d bytes ending in .pdf", got, len(got), maxFilenameLength)
+	}
+}
+
+func FuzzSanitizeFilename(f *testing.F) {
+	for _, seed := range []string{"invoice.pdf", "../../.bashrc", `..\..\x`, "CON.pdf", "a\u202eb", "x. . ", "", "\xff\xfe", strings.Repeat("€", 100)} {
+		f.Add(seed)
+	}
+	dir := filepath.Join("output", "invoices")
+	
+	f.Fuzz(func(t *testing.T, name string) {
+		got := sanitizeFilename(name)
+		switch {
+		case got == "":
+			t.Fatalf("sanitizeFilename(%q) is empty", name)
+		case !utf8.ValidString(got):
+			t.Fatalf("sanitizeFilename(%q) = %q is not valid UTF-8", name, got)
+		case len(got) > maxFilenameLength:
+			t.Fatalf("sanitizeFilename(%q) = %q is %d bytes long", name, got, len(got))
+		case strings.ContainsAny(got, `/\`):
+			t.Fatalf("sanitizeFilename(%q) = %q contains a path separator", name, got)
+		}
+		if joined := filepath.Join(dir, got); filepath.Dir(joined) != dir {
+			t.Fatalf("sanitizeFilename(%q) = %q leaves %s", name, got, dir)
+		}
+	})
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
-	"log"
 	"regexp"
 	"strings"
 	"time"
@@ -12,23 +12,68 @@ import (
 	"github.com/emersion/go-imap/client"
 )
 
-func matchesKeywords(text string, keywords []string) bool {
+// matchKeyword returns the first keyword found in the text, or ""
+func matchKeyword(text string, keywords []string) string {
 	lower := strings.ToLower(text)
 	for _, keyword := range keywords {
 		// Use regex with word boundaries for precise matching
 		pattern := `\b` + regexp.QuoteMeta(strings.ToLower(keyword)) + `\b`
 		matched, err := regexp.MatchString(pattern, lower)
 		if err == nil && matched {
-			return true
+			return keyword
 		}
 		// Fallback to simple contains check
 		if strings.Contains(lower, strings.ToLower(keyword)) {
-			return true
+			return keyword
 		}
 	}
-	return false
+	return ""
 }
 
+// fetchTextSnippets fetches the start of text parts of a batch of messages
+// and returns their decoded, lower case text by UID
+func fetchTextSnippets(c *client.Client, requests []sectionRequest, maxBytes int) map[uint32]string {
+	snippets := make(map[uint32]string)
+	if len(requests) == 0 {
+		return snippets
+	}
+	
+	parts, err := fetchSections(c, requests, maxBytes)
+	if err != nil {
+		fmt.Printf("Body fetch error: %v\n", err)
+	}
+	for uid, bySection := range parts {
+		var text strings.Builder
+		for _, part := range bySection {
+			body, err := newTransferDecoder(part.body, part.encoding)
+			if err != nil {
+				continue
+			}
+			// Truncated encodings end with a decode error, the text before it is kept
+			data, _ := io.ReadAll(io.LimitReader(body, int64(maxBytes)))
+			text.Write(bytes.ToLower(data))
+			text.WriteString("\n")
+		}
+		snippets[uid] = text.String()
+	}
+	return snippets
+}
+
+// sentToGroup returns the first To address of a message that is a group
+// address of the user's domain, or ""
+func sentToGroup(envelope *imap.Envelope, userEmail string) string {
+	// Check all To addresses, not just the first
+	for _, to := range envelope.To {
+		if to != nil && isGroupEmail(to.Address(), userEmail) {
+			return to.Address()
+		}
+	}
+	return ""
+}
+
+// Typical group addresses that receive invoices, combined with the account's domain
+var groupPrefixes = []string{"admin@", "bills@", "billing@", "dev@", "finance@", "accounting@", "ops@", "support@"}
+
 func isGroupEmail(emailAddr, userEmail string) bool {
 	if emailAddr == "" || userEmail == "" {
 		return false
@@ -42,8 +87,6 @@ func isGroupEmail(emailAddr, userEmail string) bool {
 	userDomain := userEmail[atIndex+1:]
 	
 	// Check typical group prefixes for the same domain
-	groupPrefixes := []string{"admin@", "bills@", "billing@", "dev@", "finance@", "accounting@", "ops@", "support@"}
-	
 	for _, prefix := range groupPrefixes {
 		groupAddr := prefix + userDomain
 		if strings.EqualFold(emailAddr, groupAddr) {
@@ -54,300 +97,195 @@ func isGroupEmail(emailAddr, userEmail string) bool {
 	return false
 }
 
-func searchAndDownloadAttachments(c *client.Client, month, outputDir, userEmail string, config *Config) error {
-	// Show all available folders (removed verbose logging)
-	mailboxes := make(chan *imap.MailboxInfo, 10)
+// searchOptions are the settings of one run, shared by all accounts
+type searchOptions struct {
+	period    searchPeriod
+	outputDir string
+	state     *syncState
+	// Skip server-side prefiltering and search every message of the period
+	exhaustive bool
+	// Narrow the search on servers without Gmail's X-GM-RAW as well
+	prefilter bool
+	// Keys of messages processed in this run, see messageKey
+	seenMessages map[string]bool
+}
+
+func searchAndDownloadAttachments(c *client.Client, opts *searchOptions, account *Account, config *Config) error {
+	period, outputDir, state := opts.period, opts.outputDir, opts.state
+	
+	// Get all available folders and pick the ones to search by SPECIAL-USE attributes
+	mailboxes := make(chan *imap.MailboxInfo, 50)
 	done := make(chan error, 1)
 	go func() {
 		done <- c.List("", "*", mailboxes)
 	}()
 
-	for range mailboxes {
-		// Silent iteration
+	folderList := []*imap.MailboxInfo{}
+	for m := range mailboxes {
+		folderList = append(folderList, m)
 	}
 
 	if err := <-done; err != nil {
-		fmt.Printf("Error getting folder list: %v\n", err)
+		fmt.Printf("Error getting folder list for search: %v\n", err)
 	}
 
-	// Get all available folders and check potentially useful ones for invoices
-	// Exclude system folders but check user folders
-	allFolders := []string{}
-	mailboxes2 := make(chan *imap.MailboxInfo, 50)
-	done2 := make(chan error, 1)
-	go func() {
-		done2 <- c.List("", "*", mailboxes2)
-	}()
+	allFolders := searchFolders(folderList, account.preset())
 
-	for m := range mailboxes2 {
-		folderName := m.Name
-		// Skip system folders except All Mail
-		if folderName == "INBOX" || 
-		   strings.HasPrefix(folderName, "[Gmail]/Drafts") ||
-		   strings.HasPrefix(folderName, "[Gmail]/Sent") ||
-		   strings.HasPrefix(folderName, "[Gmail]/Spam") ||
-		   strings.HasPrefix(folderName, "[Gmail]/Trash") ||
-		   strings.HasPrefix(folderName, "[Gmail]/Important") ||
-		   strings.HasPrefix(folderName, "[Gmail]/Starred") ||
-		   folderName == "[Gmail]" {
-			continue
-		}
-		
-		// Add All Mail and user folders
-		if folderName == "[Gmail]/All Mail" || !strings.HasPrefix(folderName, "[Gmail]/") {
-			allFolders = append(allFolders, folderName)
-		}
+	condStore := supportsCondStore(c)
+	query := buildSearchQuery(c, opts, account, config)
+	
+	// INBOX goes first: messages already seen there are skipped in All Mail and labels
+	classifier, err := newClassifier(config, account)
+	if err != nil {
+		return err
 	}
-
-	if err := <-done2; err != nil {
-		fmt.Printf("Error getting folder list for search: %v\n", err)
+	
+	inboxAttachmentCount, err := processInbox(c, opts, account, config, classifier, query, condStore)
+	if err != nil {
+		return err
 	}
-
-	totalAttachments := 0
 	
+	totalAttachments := 0
 	for _, folderName := range allFolders {
-		// Silently check folder
-		_, err := c.Select(folderName, false)
+		// HIGHESTMODSEQ is read before searching so changes during the run are seen next time
+		var modSeq uint64
+		if condStore {
+			modSeq = highestModSeq(c, folderName)
+		}
+		
+		// Open folder read-only (EXAMINE) so nothing can change flags
+		status, err := c.Select(folderName, true)
 		if err != nil {
 			fmt.Printf("Error opening folder %s: %v\n", folderName, err)
 			continue
 		}
 		
-		// Search for invoices in folder
-		specialCriteria := createSearchCriteria(month)
-		specialUids, err := c.UidSearch(specialCriteria)
+		// Search for invoices in folder, only new or changed messages since the last run
+		saved := usableFolderState(state.folder(account.label(), folderName), query, folderName)
+		specialUids, err := searchFolderUids(c, status, query, saved, modSeq)
 		if err != nil {
 			fmt.Printf("Search error in %s: %v\n", folderName, err)
 			continue
 		}
-		if len(specialUids) > 0 {
-			attachmentCount := processSpecialFolder(c, specialUids, outputDir, folderName, config)
+		
+		// Skip messages already processed from another folder or label
+		newUids, err := filterSeenMessages(c, specialUids, opts, account)
+		if err != nil {
+			fmt.Printf("Error reading message IDs in %s: %v\n", folderName, err)
+			continue
+		}
+		if len(newUids) > 0 {
+			attachmentCount, err := processFolder(c, classifier, newUids, period, outputDir, folderName, account, config)
 			totalAttachments += attachmentCount
+			if err != nil {
+				// Keep the old position so the folder is retried next run
+				continue
+			}
+		}
+		
+		state.setFolder(account.label(), folderName, nextFolderState(status, saved, query, specialUids, modSeq))
+		if err := state.save(); err != nil {
+			fmt.Printf("Sync state save error: %v\n", err)
 		}
 	}
 	
 	fmt.Printf("Downloaded %d attachments from additional folders\n", totalAttachments)
+	fmt.Printf("Total downloaded: %d attachments (INBOX) + %d attachments (special folders) = %d attachments\n", 
+		inboxAttachmentCount, totalAttachments, inboxAttachmentCount+totalAttachments)
+	return nil
+}
 
-	// Select INBOX
-	_, err := c.Select("INBOX", false)
+// processInbox searches and classifies INBOX and returns the number of downloaded attachments
+func processInbox(c *client.Client, opts *searchOptions, account *Account, config *Config, classifier *Classifier, query searchQuery, condStore bool) (int, error) {
+	period, outputDir, state := opts.period, opts.outputDir, opts.state
+	
+	var inboxModSeq uint64
+	if condStore {
+		inboxModSeq = highestModSeq(c, "INBOX")
+	}
+	
+	// Select INBOX read-only (EXAMINE)
+	status, err := c.Select("INBOX", true)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Removed verbose logging
 
-	// Create search criteria for specified month
-	criteria := createSearchCriteria(month)
-	
-	// Search emails using UidSearch
-	uids, err := c.UidSearch(criteria)
+	// Search new or changed emails of the month since the last run
+	saved := usableFolderState(state.folder(account.label(), "INBOX"), query, "INBOX")
+	uids, err := searchFolderUids(c, status, query, saved, inboxModSeq)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Removed verbose logging
 
-	if len(uids) == 0 {
-		return nil
+	// Each message is processed once per run and account, however many folders hold it
+	newUids, err := filterSeenMessages(c, uids, opts, account)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(newUids) == 0 {
+		state.setFolder(account.label(), "INBOX", nextFolderState(status, saved, query, uids, inboxModSeq))
+		return 0, state.save()
 	}
 	
 	// Process all found emails
 	// Removed verbose logging
+	inboxAttachmentCount, fetchErr := processFolder(c, classifier, newUids, period, outputDir, "INBOX", account, config)
 
-	// Process emails in batches to avoid hanging
-	batchSize := 10
-	inboxAttachmentCount := 0
+	fmt.Printf("Downloaded %d attachments from INBOX\n", inboxAttachmentCount)
 	
-	for i := 0; i < len(uids); i += batchSize {
-		end := i + batchSize
-		if end > len(uids) {
-			end = len(uids)
-		}
-		
-		batchUids := uids[i:end]
-		// Removed verbose progress logging
-		
-		seqset := new(imap.SeqSet)
-		seqset.AddNum(batchUids...)
-
-		messages := make(chan *imap.Message, batchSize)
-		done := make(chan error, 1)
-		go func() {
-			done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchBodyStructure, imap.FetchBody}, messages)
-		}()
-
-		processed := 0
-		for msg := range messages {
-			processed++
-			
-			subject := ""
-			if msg.Envelope != nil && msg.Envelope.Subject != "" {
-				subject = msg.Envelope.Subject
-			}
-			
-			fromEmail := ""
-			if msg.Envelope != nil && len(msg.Envelope.From) > 0 && msg.Envelope.From[0] != nil {
-				fromEmail = msg.Envelope.From[0].Address()
-			}
-
-			// Removed debug To addresses logging
-			
-			// Removed verbose service detection logging
-			
-			// Check if email is invoice by subject
-			isInvoiceSubject := checkInvoiceSubject(subject, config)
-			
-			// Determine if this is an email from group address
-			isForwarded := false
-			groupEmail := ""
-			if msg.Envelope != nil && len(msg.Envelope.To) > 0 {
-				// Check all To addresses, not just the first
-				for _, to := range msg.Envelope.To {
-					if to != nil {
-						toAddr := to.Address()
-						if isGroupEmail(toAddr, userEmail) {
-							isForwarded = true
-							groupEmail = toAddr
-							break
-						}
-					}
-				}
-			}
-			
-			// Search email content for PagerDuty bank details
-			containsPagerDutyBank := false
-			if msg.Body != nil {
-				for _, body := range msg.Body {
-					if body != nil {
-						bodyBytes, err := io.ReadAll(body)
-						if err == nil {
-							bodyText := strings.ToLower(string(bodyBytes))
-							if strings.Contains(bodyText, "pagerduty invoice") || strings.Contains(bodyText, "pagerduty billing") {
-								containsPagerDutyBank = true
-								// Removed verbose PagerDuty detection logging
-								break
-							}
-						}
-					}
-				}
-			}
-			
-			// Find attachments
-			var attachments []attachmentInfo
-			if msg.BodyStructure != nil {
-				attachments = findAttachments(msg.BodyStructure, []string{})
-			}
-			
-			if len(attachments) > 0 {
-				// Removed verbose attachment listing
-				
-				for _, attachment := range attachments {
-					// Removed verbose attachment name logging
-					
-					isInvoiceFileName := isInvoiceFile(attachment.filename, config.Keywords)
-					
-					// Explicitly exclude invite files regardless of other conditions
-					if strings.Contains(strings.ToLower(attachment.filename), "invite") {
-						// Removed verbose skip logging
-						continue
-					}
-					
-					// Determine if this is an email from group address
-					isGroupEmailMsg := isForwarded && isGroupEmail(groupEmail, userEmail)
-					
-					// Download if:
-					// 1. File name looks like invoice, OR
-					// 2. Email subject looks like invoice, OR  
-					// 3. Email came to group address (admin@, bills@, dev@ etc. of same domain)
-					// 4. Email contains PagerDuty bank details
-					if isInvoiceFileName || isInvoiceSubject || isGroupEmailMsg || containsPagerDutyBank {
-						// Removed verbose download attempt logging
-						if err := downloadAttachment(c, msg.Uid, attachment, outputDir, subject, fromEmail); err != nil {
-							fmt.Printf("Download error: %v\n", err)
-						} else {
-							inboxAttachmentCount++
-							// Reason tracking removed
-							fmt.Printf("Downloaded: %s\n", attachment.filename)
-						}
-					} else {
-						// Removed verbose skip logging
-					}
-				}
-			} else if isInvoiceSubject {
-				// Removed verbose warning about emails without attachments
-			}
-		}
-		
-		if err := <-done; err != nil {
-			fmt.Printf("Error processing emails: %v\n", err)
-			continue
-		}
-		
-		// Removed verbose batch completion logging
+	// Keep the old position after fetch errors so INBOX is retried next run
+	if fetchErr != nil {
+		return inboxAttachmentCount, nil
 	}
-
-	fmt.Printf("Downloaded %d attachments from INBOX\n", inboxAttachmentCount)
-	fmt.Printf("Total downloaded: %d attachments (INBOX) + %d attachments (special folders) = %d attachments\n", 
-		inboxAttachmentCount, totalAttachments, inboxAttachmentCount+totalAttachments)
-	return nil
+	state.setFolder(account.label(), "INBOX", nextFolderState(status, saved, query, uids, inboxModSeq))
+	return inboxAttachmentCount, state.save()
 }
 
-func createSearchCriteria(month string) *imap.SearchCriteria {
-	if month == "" {
-		log.Fatal("Month cannot be empty")
-	}
-
-	// Parse month
-	date, err := time.Parse("2006-01", month)
-	if err != nil {
-		log.Fatal("Invalid month format (need YYYY-MM):", err)
-	}
-
-	// Check that month is not in the future
+func createSearchCriteria(period searchPeriod) *imap.SearchCriteria {
+	// Check that period is not in the future
 	now := time.Now()
-	if date.After(now) {
-		fmt.Printf("Warning: month %s is in the future, there may be no emails\n", month)
+	if period.start.After(now) {
+		fmt.Printf("Warning: period %s is in the future, there may be no emails\n", period.label)
 	}
 
-	// Start and end of month
-	startOfMonth := date
-	endOfMonth := date.AddDate(0, 1, 0).Add(-time.Second)
-
+	// IMAP SINCE/BEFORE compare dates in the server's timezone, so the search is
+	// widened by a day on each side and messages are filtered by messageDate
 	criteria := &imap.SearchCriteria{
-		Since:  startOfMonth,
-		Before: endOfMonth.AddDate(0, 0, 1), // Before does not include specified date
+		Since:  period.start.AddDate(0, 0, -1),
+		Before: period.end.AddDate(0, 0, 1), // Before does not include specified date
 	}
 
 	return criteria
 }
 
-func checkInvoiceSubject(subject string, config *Config) bool {
+// invoiceSubjectMatch describes the vendor invoice phrase of a subject, or
+// returns ""; configured keywords are weighed by the classifier
+func invoiceSubjectMatch(subject string) string {
 	if subject == "" {
-		return false
-	}
-	
-	// Use configured keywords for checking
-	if matchesKeywords(subject, config.Keywords) {
-		return true
+		return ""
 	}
 	
 	// Special patterns
 	lower := strings.ToLower(subject)
 	
-	specialWords := []string{
-		"digital realty", "google workspace", "google cloud",
-		"pagerduty invoice", "new pagerduty invoice",
-		"mailgun", "mailgun technologies", "you have a new", "new invoice",
-		"statuscake", "status cake", "trafficcake",
+	if vendor, pattern := vendorPattern(lower, func(v *Vendor) []string { return v.InvoiceSubjectPatterns }); vendor != nil {
+		return fmt.Sprintf("%s phrase %q", vendor.ID, pattern)
 	}
 	
-	for _, word := range specialWords {
-		if strings.Contains(lower, word) {
-			return true
-		}
+	return ""
+}
+
+// messageDate is the Date header of a message, or its INTERNALDATE when the header is missing
+func messageDate(msg *imap.Message) time.Time {
+	if msg.Envelope != nil && !msg.Envelope.Date.IsZero() {
+		return msg.Envelope.Date
 	}
-	
-	return false
+	return msg.InternalDate
 }
 
 func truncateSubject(subject string) string {
@@ -357,11 +295,14 @@ func truncateSubject(subject string) string {
 	return subject
 }
 
-func processSpecialFolder(c *client.Client, uids []uint32, outputDir, folderName string, config *Config) int {
+// processFolder classifies new messages of the selected folder in batches and
+// downloads the attachments the classifier picks
+func processFolder(c *client.Client, classifier *Classifier, uids []uint32, period searchPeriod, outputDir, folderName string, account *Account, config *Config) (int, error) {
 	// Removed verbose folder processing logging
 	
 	attachmentCount := 0
 	batchSize := 10
+	var fetchErr error
 	
 	for i := 0; i < len(uids); i += batchSize {
 		end := i + batchSize
@@ -378,87 +319,61 @@ func processSpecialFolder(c *client.Client, uids []uint32, outputDir, folderName
 		messages := make(chan *imap.Message, batchSize)
 		done := make(chan error, 1)
 		go func() {
-			done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchBodyStructure, imap.FetchBody}, messages)
+			done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchBodyStructure}, messages)
 		}()
 
+		var batch []*imap.Message
 		for msg := range messages {
-			subject := ""
-			if msg.Envelope != nil && msg.Envelope.Subject != "" {
-				subject = msg.Envelope.Subject
-			}
-			
-			fromEmail := ""
-			if msg.Envelope != nil && len(msg.Envelope.From) > 0 && msg.Envelope.From[0] != nil {
-				fromEmail = msg.Envelope.From[0].Address()
-			}
-			
-			// Removed verbose email UID logging
-			
-			// Removed verbose service detection logging
-			
-			// Check if email subject is invoice
-			isInvoiceSubject := checkInvoiceSubject(subject, config)
-			if isInvoiceSubject {
-				// Removed verbose subject detection logging
+			// Skip messages from the extra days around the period
+			if period.contains(messageDate(msg)) {
+				batch = append(batch, msg)
 			}
-			
-			// Read content to search for PagerDuty bank details
-			if msg.Body != nil {
-				for _, body := range msg.Body {
-					if body != nil {
-						bodyBytes, err := io.ReadAll(body)
-						if err == nil {
-							bodyText := strings.ToLower(string(bodyBytes))
-							if strings.Contains(bodyText, "pagerduty invoice") || strings.Contains(bodyText, "pagerduty billing") {
-								// Removed verbose PagerDuty detection logging
-								break
-							}
-						}
-					}
-				}
+		}
+		
+		if err := <-done; err != nil {
+			fmt.Printf("Error processing %s emails: %v\n", folderName, err)
+			fetchErr = err
+			continue
+		}
+		
+		// Text parts are only fetched where the body could still qualify an attachment
+		var textParts []sectionRequest
+		for _, msg := range batch {
+			if !classifier.needsBody(newClassifiedMessage(msg, folderName)) {
+				continue
 			}
-			
-			var attachments []attachmentInfo
-			if msg.BodyStructure != nil {
-				attachments = findAttachments(msg.BodyStructure, []string{})
+			for _, part := range findTextParts(msg.BodyStructure, []string{}) {
+				textParts = append(textParts, sectionRequest{info: messageInfo{uid: msg.Uid}, attachment: part})
 			}
+		}
+		snippets := fetchTextSnippets(c, textParts, config.bodyScanLimit())
+		
+		var wanted []sectionRequest
+		for _, msg := range batch {
+			classified := newClassifiedMessage(msg, folderName)
+			classified.bodySnippet = snippets[msg.Uid]
 			
-			if len(attachments) > 0 {
-				// Removed verbose attachment count logging
-				for _, attachment := range attachments {
-					// Removed verbose attachment name logging
-					
-					// Explicitly exclude invite files regardless of other conditions
-					if strings.Contains(strings.ToLower(attachment.filename), "invite") {
-						// Removed verbose skip logging
-						continue
-					}
-					
-					// Check if this is an invoice file
-					isInvoiceFileName := isInvoiceFile(attachment.filename, config.Keywords)
-					
-					if isInvoiceFileName {
-						// Removed verbose download attempt logging
-						if err := downloadAttachment(c, msg.Uid, attachment, outputDir, subject, fromEmail); err != nil {
-							fmt.Printf("Download error: %v\n", err)
-						} else {
-							attachmentCount++
-							fmt.Printf("  ✓ Downloaded: %s (from %s)\n", attachment.filename, folderName)
-						}
-					} else {
-						// Removed verbose skip logging
-					}
+			info := newMessageInfo(msg, account, folderName)
+			for _, decision := range classifier.classify(classified) {
+				if decision.download {
+					wanted = append(wanted, sectionRequest{info: info, attachment: decision.attachment, reasons: decision.reasons})
+				} else if decision.review {
+					fmt.Printf("For review: %s (score %.2f)\n", decision.attachment.filename, decision.score)
+					report.record(info, decision.attachment, outcomeReview, "", nil, decision.reasons)
+				} else {
+					report.record(info, decision.attachment, outcomeSkipped, "", nil, decision.reasons)
 				}
-			} else {
-				// Removed verbose no-attachments logging
 			}
 		}
 		
-		if err := <-done; err != nil {
-			fmt.Printf("Error processing %s emails: %v\n", folderName, err)
+		// All wanted attachments of the batch, one round trip per 16 MiB
+		downloaded, err := downloadAttachments(c, wanted, outputDir)
+		attachmentCount += downloaded
+		if err != nil {
+			fetchErr = err
 		}
 		// Removed verbose batch completion logging
 	}
 	
-	return attachmentCount
-}
\ No newline at end of file
+	return attachmentCount, fetchErr
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+)
+
+// testDate lies in the period of testPeriod
+var testDate = time.Date(2025, 9, 10, 12, 0, 0, 0, time.UTC)
+
+// testPeriod is September 2025 in UTC
+func testPeriod(t *testing.T) searchPeriod {
+	t.Helper()
+	period, err := parsePeriod(periodFlags{month: "2025-09"}, 0, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return period
+}
+
+// testPDF is a PDF-looking attachment of the given size
+func testPDF(size int) []byte {
+	data := []byte("%PDF-1.4\n")
+	return append(data, strings.Repeat("x", max(size-len(data), 0))...)
+}
+
+// testMessage builds a multipart message with a text part and one base64
+// encoded attachment
+func testMessage(subject, filename string, content []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	var lines []string
+	for len(encoded) > 76 {
+		lines = append(lines, encoded[:76])
+		encoded = encoded[76:]
+	}
+	lines = append(lines, encoded)
+	
+	return "From: billing@stripe.com\r\n" +
+		"To: username@example.com\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + testDate.Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <" + filename + "@example.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=BOUNDARY\r\n\r\n" +
+		"--BOUNDARY\r\nContent-Type: text/plain\r\n\r\nPlease find attached.\r\n" +
+		"--BOUNDARY\r\nContent-Type: application/pdf; name=\"" + filename + "\"\r\n" +
+		"Content-Disposition: attachment; filename=\"" + filename + "\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		strings.Join(lines, "\r\n") + "\r\n" +
+		"--BOUNDARY--\r\n"
+}
+
+// seenOnFetchBackend marks messages \Seen when a body section is fetched
+// without PEEK, like real servers do; the memory backend never does
+type seenOnFetchBackend struct {
+	backend.Backend
+}
+
+func (b seenOnFetchBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := b.Backend.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return seenOnFetchUser{user}, nil
+}
+
+type seenOnFetchUser struct {
+	backend.User
+}
+
+func (u seenOnFetchUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mailbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return seenOnFetchMailbox{mailbox}, nil
+}
+
+type seenOnFetchMailbox struct {
+	backend.Mailbox
+}
+
+// bodyFetches counts the FETCH commands asking for body sections
+var bodyFetches int
+
+func (m seenOnFetchMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	if err := m.Mailbox.ListMessages(uid, seqSet, items, ch); err != nil {
+		return err
+	}
+	counted := false
+	for _, item := range items {
+		section, err := imap.ParseBodySectionName(item)
+		if err != nil {
+			continue
+		}
+		if !counted {
+			bodyFetches++
+			counted = true
+		}
+		if !section.Peek {
+			return m.Mailbox.UpdateMessagesFlags(uid, seqSet, imap.AddFlags, []string{imap.SeenFlag})
+		}
+	}
+	return nil
+}
+
+// startTestServer runs an in-memory IMAP server and returns a logged in client
+func startTestServer(t *testing.T) *client.Client {
+	t.Helper()
+	s := server.New(seenOnFetchBackend{memory.New()})
+	s.AllowInsecureAuth = true
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+	
+	c, err := client.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Logout()
+		s.Close()
+	})
+	return c
+}
+
+// appendTestMessage stores an unread message, creating the folder if needed
+func appendTestMessage(t *testing.T, c *client.Client, folder, message string) {
+	t.Helper()
+	if folder != "INBOX" {
+		c.Create(folder)
+	}
+	if err := c.Append(folder, nil, testDate, imap.Literal(strings.NewReader(message))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runTestSearch runs one search of testPeriod with fresh state and returns
+// the output folder
+func runTestSearch(t *testing.T, c *client.Client, config *Config) string {
+	t.Helper()
+	root := t.TempDir()
+	outputDir := filepath.Join(root, "invoices_2025-09")
+	archive = newDownloadIndex(filepath.Join(root, indexFileName))
+	report = newRunReport(outputDir)
+	
+	opts := &searchOptions{
+		period:       testPeriod(t),
+		outputDir:    outputDir,
+		state:        newSyncState(outputDir, "2025-09"),
+		seenMessages: make(map[string]bool),
+	}
+	if err := searchAndDownloadAttachments(c, opts, &config.Account, config); err != nil {
+		t.Fatal(err)
+	}
+	return outputDir
+}
+
+// testConfig is a single account configuration matching the test server
+func testConfig() *Config {
+	config := &Config{Keywords: []string{"invoice", "receipt"}}
+	config.Email = "username@example.com"
+	return config
+}
+
+// savedFiles lists the attachments saved in a folder
+func savedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".pdf") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// folderFlags returns the flags of every message of a folder by UID
+func folderFlags(t *testing.T, c *client.Client, folder string) map[uint32]string {
+	t.Helper()
+	status, err := c.Select(folder, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := make(map[uint32]string)
+	if status.Messages == 0 {
+		return flags
+	}
+	
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, messages)
+	}()
+	for msg := range messages {
+		sort.Strings(msg.Flags)
+		flags[msg.Uid] = strings.Join(msg.Flags, " ")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return flags
+}
+
+func TestSearchLeavesFlagsUnchanged(t *testing.T) {
+	c := startTestServer(t)
+	appendTestMessage(t, c, "INBOX", testMessage("Your invoice", "invoice_2025_09.pdf", testPDF(4000)))
+	appendTestMessage(t, c, "INBOX", testMessage("Your receipt", "receipt_0001.pdf", testPDF(6000)))
+	appendTestMessage(t, c, "Receipts", testMessage("Payment", "invoice_label.pdf", testPDF(5000)))
+	
+	folders := []string{"INBOX", "Receipts"}
+	before := make(map[string]map[uint32]string)
+	for _, folder := range folders {
+		before[folder] = folderFlags(t, c, folder)
+	}
+	
+	outputDir := runTestSearch(t, c, testConfig())
+	
+	if files := savedFiles(t, outputDir); len(files) != 3 {
+		t.Fatalf("saved %v, want 3 attachments", files)
+	}
+	for _, folder := range folders {
+		after := folderFlags(t, c, folder)
+		if len(after) != len(before[folder]) {
+			t.Fatalf("%s has %d messages after the run, %d before", folder, len(after), len(before[folder]))
+		}
+		for uid, flags := range after {
+			if flags != before[folder][uid] {
+				t.Errorf("%s UID %d flags changed from %q to %q", folder, uid, before[folder][uid], flags)
+			}
+			if strings.Contains(flags, imap.SeenFlag) && !strings.Contains(before[folder][uid], imap.SeenFlag) {
+				t.Errorf("%s UID %d was marked %s", folder, uid, imap.SeenFlag)
+			}
+		}
+	}
+}
+
+func TestSearchCountsOnlyEarlierRunsAsAlreadyHave(t *testing.T) {
+	c := startTestServer(t)
+	content := testPDF(4000)
+	appendTestMessage(t, c, "INBOX", testMessage("Your invoice", "invoice_a.pdf", content))
+	appendTestMessage(t, c, "INBOX", testMessage("Your invoice again", "invoice_b.pdf", content))
+	
+	outputDir := runTestSearch(t, c, testConfig())
+	
+	if files := savedFiles(t, outputDir); len(files) != 1 {
+		t.Fatalf("saved %v, want 1 attachment", files)
+	}
+	if archive.alreadyHave != 0 {
+		t.Errorf("alreadyHave = %d for a duplicate within the run, want 0", archive.alreadyHave)
+	}
+	if n := report.counts[outcomeAlreadyHave]; n != 1 {
+		t.Errorf("report has %d already have, want 1", n)
+	}
+}
+
+func TestSearchFetchesLargePartsInChunks(t *testing.T) {
+	defer func(batch, chunk int) {
+		maxFetchBytes, fetchChunkBytes = batch, chunk
+	}(maxFetchBytes, fetchChunkBytes)
+	maxFetchBytes, fetchChunkBytes = 12000, 8192
+	
+	c := startTestServer(t)
+	large := testPDF(20000)
+	appendTestMessage(t, c, "INBOX", testMessage("Your invoice", "invoice_large.pdf", large))
+	// Encoded to exactly two chunks, the last fetch returns nothing
+	exact := testPDF(11973)
+	appendTestMessage(t, c, "INBOX", testMessage("Your invoice", "invoice_exact.pdf", exact))
+	appendTestMessage(t, c, "INBOX", testMessage("Your receipt", "receipt_1.pdf", testPDF(5000)))
+	appendTestMessage(t, c, "INBOX", testMessage("Your receipt", "receipt_2.pdf", testPDF(5001)))
+	before := folderFlags(t, c, "INBOX")
+	
+	outputDir := runTestSearch(t, c, testConfig())
+	
+	if files := savedFiles(t, outputDir); len(files) != 4 {
+		t.Fatalf("saved %v, want 4 attachments", files)
+	}
+	for name, want := range map[string][]byte{"stripe_invoice_large.pdf": large, "stripe_invoice_exact.pdf": exact} {
+		got, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("%s has %d bytes, want the %d bytes sent", name, len(got), len(want))
+		}
+	}
+	after := folderFlags(t, c, "INBOX")
+	for uid, flags := range after {
+		if flags != before[uid] {
+			t.Errorf("UID %d flags changed from %q to %q", uid, before[uid], flags)
+		}
+	}
+}
+
+func TestSearchProcessesMessageOncePerAccount(t *testing.T) {
+	c := startTestServer(t)
+	message := testMessage("Your invoice", "invoice_2025_09.pdf", testPDF(4000))
+	appendTestMessage(t, c, "INBOX", message)
+	appendTestMessage(t, c, "Receipts", message)
+	
+	outputDir := runTestSearch(t, c, testConfig())
+	
+	if files := savedFiles(t, outputDir); len(files) != 1 {
+		t.Fatalf("saved %v, want 1 attachment", files)
+	}
+	if n := report.counts[outcomeAlreadyHave]; n != 0 {
+		t.Errorf("second copy was fetched and reported as already have %d times, want it skipped by Message-ID", n)
+	}
+}
+
+func TestDownloadAttachmentsReturnsOnlyRetryableErrors(t *testing.T) {
+	defer func(chunk int) {
+		fetchChunkBytes = chunk
+	}(fetchChunkBytes)
+	fetchChunkBytes = 8192
+	
+	c := startTestServer(t)
+	appendTestMessage(t, c, "INBOX", testMessage("Your invoice", "invoice_fake.pdf", []byte("not a PDF at all")))
+	outputDir := runTestSearch(t, c, testConfig())
+	if n := report.counts[outcomeFailed]; n != 1 {
+		t.Fatalf("%d failed, want the fake PDF", n)
+	}
+	
+	// The appended message has the highest UID; folderFlags leaves INBOX selected
+	var uid uint32
+	for u := range folderFlags(t, c, "INBOX") {
+		uid = max(uid, u)
+	}
+	pdf := attachmentInfo{filename: "invoice_fake.pdf", section: "2", encoding: "base64", mimeType: "application/pdf", size: 24}
+	if _, err := downloadAttachments(c, []sectionRequest{{info: messageInfo{uid: uid}, attachment: pdf}}, outputDir); err != nil {
+		t.Errorf("bad content returned a retryable error: %v", err)
+	}
+	
+	large := pdf
+	large.size = 20000
+	for _, attachment := range []attachmentInfo{pdf, large} {
+		_, err := downloadAttachments(c, []sectionRequest{{info: messageInfo{uid: uid + 1}, attachment: attachment}}, outputDir)
+		if !errors.Is(err, errFetch) {
+			t.Errorf("part of a missing message (%d bytes): %v, want errFetch", attachment.size, err)
+		}
+	}
+}
+
+func TestFetchSectionsUsesOneCommandPerBatch(t *testing.T) {
+	c := startTestServer(t)
+	appendTestMessage(t, c, "INBOX", testMessage("Your invoice", "invoice_1.pdf", testPDF(3000)))
+	appendTestMessage(t, c, "INBOX", testMessage("Your invoice", "invoice_2.pdf", testPDF(3000)))
+	flags := folderFlags(t, c, "INBOX")
+	var uids []uint32
+	for uid := range flags {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	first, second := uids[len(uids)-2], uids[len(uids)-1]
+	
+	pdf := attachmentInfo{section: "2", encoding: "base64", size: 4000}
+	text := attachmentInfo{section: "1", encoding: "7bit", size: 30}
+	requests := []sectionRequest{
+		{info: messageInfo{uid: first}, attachment: pdf},
+		{info: messageInfo{uid: second}, attachment: text},
+		{info: messageInfo{uid: second}, attachment: pdf},
+	}
+	
+	bodyFetches = 0
+	parts, err := fetchSections(c, requests, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyFetches != 1 {
+		t.Errorf("%d FETCH commands for two sets of sections, want 1", bodyFetches)
+	}
+	if len(parts[first]) != 1 || len(parts[second]) != 2 {
+		t.Errorf("got sections %v and %v, want only the requested ones", parts[first], parts[second])
+	}
+	if _, ok := parts[first]["1"]; ok {
+		t.Errorf("unrequested text part of UID %d kept", first)
+	}
+}
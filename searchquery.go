@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// searchQuery is a folder search: standard criteria plus an optional Gmail
+// X-GM-RAW query, which go-imap cannot express
+type searchQuery struct {
+	criteria *imap.SearchCriteria
+	gmailRaw string
+	// Server-side narrowing of the date search, "" when every message of
+	// the period is searched; kept in the sync state
+	filter string
+}
+
+// withUids returns a copy of the query limited to the given UIDs
+func (q searchQuery) withUids(uids *imap.SeqSet) searchQuery {
+	criteria := *q.criteria
+	criteria.Uid = uids
+	q.criteria = &criteria
+	return q
+}
+
+// uidSearch runs UID SEARCH, adding the X-GM-RAW query and any extra raw
+// search keys (e.g. MODSEQ) to the standard criteria
+func uidSearch(c *client.Client, query searchQuery, extra ...interface{}) ([]uint32, error) {
+	if query.gmailRaw == "" && len(extra) == 0 {
+		return c.UidSearch(query.criteria)
+	}
+	
+	args := extra
+	if query.gmailRaw != "" {
+		args = append(args, imap.RawString("X-GM-RAW"), query.gmailRaw)
+	}
+	
+	cmd := &commands.Uid{Cmd: &extendedSearch{criteria: query.criteria, extra: args}}
+	res := &extendedSearchResponse{}
+	
+	status, err := c.Execute(cmd, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	
+	return res.ids, nil
+}
+
+// extendedSearch is a SEARCH with search keys go-imap does not support
+type extendedSearch struct {
+	criteria *imap.SearchCriteria
+	extra    []interface{}
+}
+
+func (cmd *extendedSearch) Command() *imap.Command {
+	args := cmd.criteria.Format()
+	args = append(args, cmd.extra...)
+	
+	return &imap.Command{
+		Name:      "SEARCH",
+		Arguments: args,
+	}
+}
+
+// extendedSearchResponse parses SEARCH results, including
+// "* SEARCH 2 5 6 (MODSEQ 917162500)" from CONDSTORE servers
+type extendedSearchResponse struct {
+	ids []uint32
+}
+
+func (r *extendedSearchResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "SEARCH" {
+		return responses.ErrUnhandled
+	}
+	
+	for _, f := range fields {
+		// Skip the trailing (MODSEQ n) list
+		if _, isList := f.([]interface{}); isList {
+			continue
+		}
+		id, err := imap.ParseNumber(f)
+		if err != nil {
+			return err
+		}
+		r.ids = append(r.ids, id)
+	}
+	
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// sectionRequest is one part wanted from a message
+type sectionRequest struct {
+	info       messageInfo
+	attachment attachmentInfo
+	// Why the attachment is wanted, see attachmentDecision
+	reasons []reason
+}
+
+// go-imap reads every literal into a buffer of its full size, so a UID FETCH
+// holds all the parts it returns in memory at once
+var (
+	// Largest total size of the wanted parts of one batch of fetches; parts
+	// only other messages of the batch asked for come on top
+	maxFetchBytes = 16 << 20
+	// Parts above this size are fetched on their own, one chunk of this size at a time
+	fetchChunkBytes = 4 << 20
+)
+
+// errFetch marks failures to get a part from the server, which a later run
+// may not hit; the folder keeps its sync position so the part is retried
+var errFetch = errors.New("attachment fetch error")
+
+// fetchedPart is the content of a part as the server returned it
+type fetchedPart struct {
+	body io.Reader
+	// Transfer encoding still to undo, "binary" when the server decoded it
+	encoding string
+}
+
+// splitFetchBatches splits requests into batches whose parts add up to at
+// most maxFetchBytes, or a single part when it is larger; parts fetched in
+// chunks do not count
+func splitFetchBatches(requests []sectionRequest) [][]sectionRequest {
+	var batches [][]sectionRequest
+	var batch []sectionRequest
+	batchBytes := 0
+	for _, req := range requests {
+		size := int(req.attachment.size)
+		if size > fetchChunkBytes {
+			size = 0
+		}
+		if len(batch) > 0 && batchBytes+size > maxFetchBytes {
+			batches = append(batches, batch)
+			batch, batchBytes = nil, 0
+		}
+		batch = append(batch, req)
+		batchBytes += size
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// fetchSections fetches the requested parts of a batch of messages, only the
+// first maxBytes of each when maxBytes > 0. UID FETCH asks every message for
+// the same items, so the batch costs one round trip for the union of the
+// wanted sections; parts a message did not ask for are dropped. Servers that
+// reject a section some message lacks get one command per set of sections.
+// Whole parts above fetchChunkBytes are not fetched here, their body fetches
+// chunks as it is read.
+func fetchSections(c *client.Client, requests []sectionRequest, maxBytes int) (map[uint32]map[string]fetchedPart, error) {
+	parts := make(map[uint32]map[string]fetchedPart)
+	wanted := make(map[uint32][]string)
+	encodings := make(map[uint32]map[string]string)
+	for _, req := range requests {
+		uid, section := req.info.uid, req.attachment.section
+		if maxBytes == 0 && int(req.attachment.size) > fetchChunkBytes {
+			if parts[uid] == nil {
+				parts[uid] = make(map[string]fetchedPart)
+			}
+			parts[uid][section] = fetchedPart{
+				body:     &chunkedPart{c: c, uid: uid, section: section},
+				encoding: req.attachment.encoding,
+			}
+			continue
+		}
+		if encodings[uid] == nil {
+			encodings[uid] = make(map[string]string)
+		}
+		if _, ok := encodings[uid][section]; !ok {
+			wanted[uid] = append(wanted[uid], section)
+		}
+		encodings[uid][section] = req.attachment.encoding
+	}
+	if len(wanted) == 0 {
+		return parts, nil
+	}
+	
+	// Group messages by their set of sections, for the fallback
+	groups := make(map[string][]uint32)
+	var keys []string
+	var uids []uint32
+	var union []string
+	inUnion := make(map[string]bool)
+	for uid, sections := range wanted {
+		sort.Strings(sections)
+		key := strings.Join(sections, " ")
+		if groups[key] == nil {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], uid)
+		uids = append(uids, uid)
+		for _, section := range sections {
+			if !inUnion[section] {
+				inUnion[section] = true
+				union = append(union, section)
+			}
+		}
+	}
+	sort.Strings(keys)
+	sort.Strings(union)
+	
+	keep := func(literals map[uint32]map[string]imap.Literal, binary bool) {
+		for uid, bySection := range literals {
+			for section, literal := range bySection {
+				encoding, ok := encodings[uid][section]
+				if !ok {
+					continue
+				}
+				if binary {
+					encoding = "binary"
+				}
+				if parts[uid] == nil {
+					parts[uid] = make(map[string]fetchedPart)
+				}
+				parts[uid][section] = fetchedPart{body: literal, encoding: encoding}
+			}
+		}
+	}
+	
+	literals, binary, err := fetchSectionsBinary(c, uids, union, maxBytes)
+	if err == nil {
+		keep(literals, binary)
+		return parts, nil
+	}
+	if len(keys) == 1 {
+		return parts, err
+	}
+	
+	fmt.Printf("Batch fetch failed, fetching by set of sections: %v\n", err)
+	var fetchErr error
+	for _, key := range keys {
+		literals, binary, err := fetchSectionsBinary(c, groups[key], strings.Fields(key), maxBytes)
+		if err != nil {
+			fetchErr = errors.Join(fetchErr, err)
+			continue
+		}
+		keep(literals, binary)
+	}
+	
+	return parts, fetchErr
+}
+
+// fetchSectionsBinary runs fetchSectionGroup with BINARY where the server has
+// it, so it decodes the parts itself, and reports whether it did
+func fetchSectionsBinary(c *client.Client, uids []uint32, sections []string, maxBytes int) (map[uint32]map[string]imap.Literal, bool, error) {
+	binary := supportsBinary(c)
+	literals, err := fetchSectionGroup(c, uids, sections, 0, maxBytes, binary)
+	if err != nil && binary {
+		// e.g. [UNKNOWN-CTE], decode locally instead
+		fmt.Printf("BINARY fetch failed, decoding locally: %v\n", err)
+		binary = false
+		literals, err = fetchSectionGroup(c, uids, sections, 0, maxBytes, binary)
+	}
+	return literals, binary, err
+}
+
+// fetchSectionGroup runs one UID FETCH of the same sections of several
+// messages, maxBytes from offset of each when maxBytes > 0
+func fetchSectionGroup(c *client.Client, uids []uint32, sections []string, offset, maxBytes int, binary bool) (map[uint32]map[string]imap.Literal, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	
+	// Partial fetch <offset.N>; the server answers with the origin only, e.g. BODY[1]<0>
+	partial, partialResponse := "", ""
+	if maxBytes > 0 {
+		partial = fmt.Sprintf("<%d.%d>", offset, maxBytes)
+		partialResponse = fmt.Sprintf("<%d>", offset)
+	}
+	
+	// PEEK keeps the messages unread
+	items := []imap.FetchItem{imap.FetchUid}
+	for _, section := range sections {
+		if binary {
+			items = append(items, imap.FetchItem("BINARY.PEEK["+section+"]"+partial))
+		} else {
+			items = append(items, imap.FetchItem("BODY.PEEK["+section+"]"+partial))
+		}
+	}
+	
+	messages := make(chan *imap.Message, len(uids))
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, items, messages)
+	}()
+	
+	literals := make(map[uint32]map[string]imap.Literal)
+	for msg := range messages {
+		bySection := make(map[string]imap.Literal)
+		if binary {
+			for _, section := range sections {
+				if literal, ok := msg.Items[imap.FetchItem("BINARY["+section+"]"+partialResponse)].(imap.Literal); ok {
+					bySection[section] = literal
+				}
+			}
+		} else {
+			for name, literal := range msg.Body {
+				if literal != nil && name.Specifier == imap.EntireSpecifier {
+					bySection[sectionPath(name.Path)] = literal
+				}
+			}
+		}
+		literals[msg.Uid] = bySection
+	}
+	
+	if err := <-done; err != nil {
+		return literals, fmt.Errorf("%w: %v", errFetch, err)
+	}
+	return literals, nil
+}
+
+// chunkedPart reads a large part with one partial fetch per fetchChunkBytes,
+// so only one chunk is in memory at a time. It always fetches the encoded
+// part: the decoder is chosen before the first chunk arrives, and a BINARY
+// failure halfway could not fall back. Reads must not overlap other commands.
+type chunkedPart struct {
+	c       *client.Client
+	uid     uint32
+	section string
+	offset  int
+	chunk   io.Reader
+	done    bool
+}
+
+func (p *chunkedPart) Read(b []byte) (int, error) {
+	for {
+		if p.chunk != nil {
+			n, err := p.chunk.Read(b)
+			if err == io.EOF {
+				p.chunk, err = nil, nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+		}
+		if p.done {
+			return 0, io.EOF
+		}
+		
+		literals, err := fetchSectionGroup(p.c, []uint32{p.uid}, []string{p.section}, p.offset, fetchChunkBytes, false)
+		if err != nil {
+			return 0, err
+		}
+		literal, ok := literals[p.uid][p.section]
+		if !ok {
+			if p.offset == 0 {
+				return 0, fmt.Errorf("%w: part %s of UID %d was not returned by the server", errFetch, p.section, p.uid)
+			}
+			// Some servers answer NIL instead of an empty literal past the end
+			return 0, io.EOF
+		}
+		
+		// A short chunk is the last one
+		p.offset += literal.Len()
+		p.done = literal.Len() < fetchChunkBytes
+		p.chunk = literal
+	}
+}
+
+// sectionPath formats a part path like 1.2
+func sectionPath(path []int) string {
+	parts := make([]string, len(path))
+	for i, n := range path {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Name of the incremental sync state file in the output directory
+const syncStateFile = ".sync_state.json"
+
+// folderState is the sync position of one folder
+type folderState struct {
+	UidValidity   uint32 `json:"uidvalidity"`
+	LastUid       uint32 `json:"last_uid"`
+	HighestModSeq uint64 `json:"highest_modseq,omitempty"`
+	// Server-side prefilter of the runs that reached LastUid, see searchQuery
+	Filter string `json:"filter,omitempty"`
+}
+
+// syncState keeps per-account, per-folder positions for one search period
+type syncState struct {
+	Period   string                             `json:"period"`
+	Accounts map[string]map[string]*folderState `json:"accounts"`
+	
+	path string
+}
+
+// newSyncState returns an empty state, used for full rescans
+func newSyncState(outputDir, period string) *syncState {
+	return &syncState{
+		Period:   period,
+		Accounts: make(map[string]map[string]*folderState),
+		path:     filepath.Join(outputDir, syncStateFile),
+	}
+}
+
+// loadSyncState reads the state for the period; a missing file or a
+// different period starts from scratch
+func loadSyncState(outputDir, period string) *syncState {
+	state := newSyncState(outputDir, period)
+	
+	data, err := os.ReadFile(state.path)
+	if err != nil {
+		return state
+	}
+	
+	var saved syncState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		fmt.Printf("Sync state parsing error, doing a full scan: %v\n", err)
+		return state
+	}
+	if saved.Period != period || saved.Accounts == nil {
+		return state
+	}
+	
+	state.Accounts = saved.Accounts
+	return state
+}
+
+func (s *syncState) folder(account, folder string) *folderState {
+	if s.Accounts[account] == nil {
+		return nil
+	}
+	return s.Accounts[account][folder]
+}
+
+// usableFolderState returns the saved position of a folder, or nil when it
+// was reached with a prefilter the query does not share: messages that
+// filter hid were never examined, so the folder is rescanned
+func usableFolderState(saved *folderState, query searchQuery, folder string) *folderState {
+	if saved != nil && saved.Filter != "" && saved.Filter != query.filter {
+		fmt.Printf("Search filter of %s changed, rescanning\n", folder)
+		return nil
+	}
+	return saved
+}
+
+func (s *syncState) setFolder(account, folder string, fs *folderState) {
+	if s.Accounts[account] == nil {
+		s.Accounts[account] = make(map[string]*folderState)
+	}
+	s.Accounts[account][folder] = fs
+}
+
+func (s *syncState) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0644)
+}
+
+// searchNewUids searches the selected folder, limited to UIDs above the saved
+// position when UIDVALIDITY is unchanged. A changed UIDVALIDITY means the old
+// UIDs are meaningless, so the whole period is rescanned.
+func searchNewUids(c *client.Client, status *imap.MailboxStatus, query searchQuery, saved *folderState) ([]uint32, error) {
+	incremental := saved != nil && saved.UidValidity == status.UidValidity && saved.LastUid > 0
+	if saved != nil && saved.UidValidity != status.UidValidity {
+		fmt.Printf("UIDVALIDITY of %s changed, rescanning\n", status.Name)
+	}
+	
+	if incremental {
+		uidRange := new(imap.SeqSet)
+		uidRange.AddRange(saved.LastUid+1, 0)
+		query = query.withUids(uidRange)
+	}
+	
+	uids, err := uidSearch(c, query)
+	if err != nil {
+		return nil, err
+	}
+	
+	if !incremental {
+		return uids, nil
+	}
+	
+	// "n:*" always matches the last message, even when its UID is below n
+	newUids := uids[:0]
+	for _, uid := range uids {
+		if uid > saved.LastUid {
+			newUids = append(newUids, uid)
+		}
+	}
+	return newUids, nil
+}
+
+// searchFolderUids returns new UIDs and, when the server supports CONDSTORE
+// (modSeq > 0), already processed UIDs whose flags or labels changed since
+// the last run. Servers without CONDSTORE only get new UIDs.
+func searchFolderUids(c *client.Client, status *imap.MailboxStatus, query searchQuery, saved *folderState, modSeq uint64) ([]uint32, error) {
+	uids, err := searchNewUids(c, status, query, saved)
+	if err != nil {
+		return nil, err
+	}
+	
+	if modSeq == 0 || saved == nil || saved.UidValidity != status.UidValidity ||
+		saved.HighestModSeq == 0 || saved.LastUid == 0 || modSeq <= saved.HighestModSeq {
+		return uids, nil
+	}
+	
+	changed, err := searchChangedUids(c, query, saved)
+	if err != nil {
+		fmt.Printf("Changed message search error in %s: %v\n", status.Name, err)
+		return uids, nil
+	}
+	
+	if len(changed) > 0 {
+		fmt.Printf("Re-evaluating %d changed messages in %s\n", len(changed), status.Name)
+	}
+	return append(changed, uids...), nil
+}
+
+// nextFolderState is the position to save after the folder was processed
+func nextFolderState(status *imap.MailboxStatus, saved *folderState, query searchQuery, uids []uint32, modSeq uint64) *folderState {
+	next := &folderState{UidValidity: status.UidValidity, HighestModSeq: modSeq, Filter: query.filter}
+	if saved != nil && saved.UidValidity == status.UidValidity {
+		next.LastUid = saved.LastUid
+	}
+	
+	// Every message below UIDNEXT has been considered by the search, as far
+	// as the filter lets it see them
+	if status.UidNext > 0 && status.UidNext-1 > next.LastUid {
+		next.LastUid = status.UidNext - 1
+	}
+	for _, uid := range uids {
+		if uid > next.LastUid {
+			next.LastUid = uid
+		}
+	}
+	return next
+}
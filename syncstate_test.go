@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestFolderStateRescansWhenFilterChanges(t *testing.T) {
+	status := &imap.MailboxStatus{Name: "INBOX", UidValidity: 7, UidNext: 101}
+	gmail := searchQuery{gmailRaw: "has:attachment {invoice}", filter: "has:attachment {invoice}"}
+	exhaustive := searchQuery{}
+	
+	saved := nextFolderState(status, nil, gmail, nil, 0)
+	if saved.LastUid != 100 || saved.Filter != gmail.filter {
+		t.Fatalf("saved %+v, want last UID 100 with the Gmail filter", saved)
+	}
+	
+	tests := []struct {
+		name  string
+		saved *folderState
+		query searchQuery
+		reuse bool
+	}{
+		{"same filter", saved, gmail, true},
+		{"exhaustive after prefiltered run", saved, exhaustive, false},
+		{"other keywords", saved, searchQuery{filter: "has:attachment {receipt}"}, false},
+		{"prefiltered after exhaustive run", nextFolderState(status, nil, exhaustive, nil, 0), gmail, true},
+	}
+	for _, tt := range tests {
+		got := usableFolderState(tt.saved, tt.query, "INBOX")
+		if (got != nil) != tt.reuse {
+			t.Errorf("%s: reused saved state %v, want %v", tt.name, got != nil, tt.reuse)
+		}
+	}
+}
+
+func TestGmailRawQuerySearchesAttachmentNames(t *testing.T) {
+	config := testConfig()
+	words, filenames, senders, recipients := prefilterTerms(&config.Account, config)
+	query := gmailRawQuery(words, filenames, senders, recipients)
+	for _, term := range []string{"filename:inv ", "filename:rechnung ", "filename:factura ", "filename:invoice ", "invoice ", "from:stripe.com "} {
+		if !strings.Contains(query, term) {
+			t.Errorf("X-GM-RAW query lacks %q: %s", term, query)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Default vendor registry, built into the binary
+//
+//go:embed vendors_default.json
+var defaultVendorsJSON []byte
+
+// User overlay of the registry, next to config.json unless vendor_file is set
+const vendorsFileName = "vendors.json"
+
+// Vendor describes how to recognize the invoices of one service; patterns
+// are case-insensitive substrings
+type Vendor struct {
+	ID string `json:"id"`
+	// Prefix of saved file names, none when empty
+	Prefix  string   `json:"prefix,omitempty"`
+	Domains []string `json:"domains,omitempty"`
+	// Subject patterns naming the vendor, checked in registry order
+	SubjectPatterns []string `json:"subject_patterns,omitempty"`
+	// Subject phrases that mark an invoice without a keyword
+	InvoiceSubjectPatterns []string `json:"invoice_subject_patterns,omitempty"`
+	BodyPatterns           []string `json:"body_patterns,omitempty"`
+	FilenamePatterns       []string `json:"filename_patterns,omitempty"`
+}
+
+// Vendor registry of the current run
+var vendors = mustParseVendors(defaultVendorsJSON)
+
+func mustParseVendors(data []byte) []Vendor {
+	list, err := parseVendors(data)
+	if err != nil {
+		panic(fmt.Sprintf("built-in vendor registry: %v", err))
+	}
+	return list
+}
+
+// parseVendors reads a registry file, lower-casing its domains and patterns
+func parseVendors(data []byte) ([]Vendor, error) {
+	var list []Vendor
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	
+	seen := make(map[string]bool)
+	for i := range list {
+		v := &list[i]
+		if v.ID == "" {
+			return nil, fmt.Errorf("vendor %d has no id", i+1)
+		}
+		if seen[v.ID] {
+			return nil, fmt.Errorf("vendor %q is listed twice", v.ID)
+		}
+		seen[v.ID] = true
+		
+		for _, patterns := range [][]string{v.Domains, v.SubjectPatterns, v.InvoiceSubjectPatterns, v.BodyPatterns, v.FilenamePatterns} {
+			for j := range patterns {
+				patterns[j] = strings.ToLower(strings.TrimSpace(patterns[j]))
+			}
+		}
+	}
+	return list, nil
+}
+
+// vendorFilePath is the configured overlay file or vendors.json in the working directory
+func vendorFilePath(config *Config) string {
+	if config.VendorFile != "" {
+		return config.VendorFile
+	}
+	return vendorsFileName
+}
+
+// loadVendors returns the built-in registry with the overlay file applied;
+// overlay entries replace built-in ones with the same id, new ones are
+// checked first so they can take precedence over generic patterns
+func loadVendors(path string) ([]Vendor, error) {
+	base := mustParseVendors(defaultVendorsJSON)
+	
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return base, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	overlay, err := parseVendors(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	
+	byID := make(map[string]Vendor)
+	for _, v := range overlay {
+		byID[v.ID] = v
+	}
+	
+	var merged []Vendor
+	for _, v := range overlay {
+		if !hasVendor(base, v.ID) {
+			merged = append(merged, v)
+		}
+	}
+	for _, v := range base {
+		if replacement, ok := byID[v.ID]; ok {
+			v = replacement
+		}
+		merged = append(merged, v)
+	}
+	return merged, nil
+}
+
+func hasVendor(list []Vendor, id string) bool {
+	for _, v := range list {
+		if v.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// vendorDomains lists the sender domains of all vendors
+func vendorDomains() []string {
+	var domains []string
+	for _, v := range vendors {
+		domains = append(domains, v.Domains...)
+	}
+	return domains
+}
+
+// invoiceSubjectPatterns lists the subject phrases of all vendors that mark invoices
+func invoiceSubjectPatterns() []string {
+	var patterns []string
+	for _, v := range vendors {
+		patterns = append(patterns, v.InvoiceSubjectPatterns...)
+	}
+	return patterns
+}
+
+// vendorBodyPatterns lists the body phrases of all vendors
+func vendorBodyPatterns() []string {
+	var patterns []string
+	for _, v := range vendors {
+		patterns = append(patterns, v.BodyPatterns...)
+	}
+	return patterns
+}
+
+// vendorFilenamePatterns lists the attachment name patterns of all vendors
+func vendorFilenamePatterns() []string {
+	var patterns []string
+	for _, v := range vendors {
+		patterns = append(patterns, v.FilenamePatterns...)
+	}
+	return patterns
+}
+
+// vendorPattern returns the vendor with a pattern found in the lower case text, and the pattern
+func vendorPattern(lower string, patterns func(v *Vendor) []string) (*Vendor, string) {
+	for i := range vendors {
+		for _, pattern := range patterns(&vendors[i]) {
+			if pattern != "" && strings.Contains(lower, pattern) {
+				return &vendors[i], pattern
+			}
+		}
+	}
+	return nil, ""
+}